@@ -0,0 +1,146 @@
+package copilotproxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// Account is a GitHub account whose Copilot token serves a share of the
+// proxied requests.
+type Account struct {
+	Name   string
+	Source *TokenSource
+
+	inFlight atomic.Int64
+}
+
+// AccountCredential is an entry of an accounts file.
+type AccountCredential struct {
+	Name       string
+	OAuthToken string
+}
+
+// ParseAccountsFile reads one name:oauth-token account per line. Blank lines
+// and lines starting with # are ignored.
+func ParseAccountsFile(file string) ([]AccountCredential, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read accounts file: %w", err)
+	}
+	var accounts []AccountCredential
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, token, ok := strings.Cut(line, ":")
+		if !ok || name == "" || token == "" {
+			return nil, fmt.Errorf("%s:%d: invalid account, expected name:oauth-token", file, i+1)
+		}
+		accounts = append(accounts, AccountCredential{Name: name, OAuthToken: token})
+	}
+	return accounts, nil
+}
+
+const (
+	BalanceRoundRobin  = "round-robin"
+	BalanceLeastLoaded = "least-loaded"
+)
+
+// AccountPool spreads requests over several accounts, skipping those
+// without a usable token.
+type AccountPool struct {
+	accounts []*Account
+	strategy string
+	next     atomic.Uint64
+}
+
+func NewAccountPool(strategy string, accounts ...*Account) (*AccountPool, error) {
+	if len(accounts) == 0 {
+		return nil, fmt.Errorf("no accounts")
+	}
+	switch strategy {
+	case BalanceRoundRobin, BalanceLeastLoaded:
+	default:
+		return nil, fmt.Errorf("unknown balancing strategy %q, expected %s or %s", strategy, BalanceRoundRobin, BalanceLeastLoaded)
+	}
+	seen := make(map[string]bool, len(accounts))
+	for _, account := range accounts {
+		if seen[account.Name] {
+			return nil, fmt.Errorf("duplicate account name %q", account.Name)
+		}
+		seen[account.Name] = true
+	}
+	return &AccountPool{accounts: accounts, strategy: strategy}, nil
+}
+
+func (p *AccountPool) Accounts() []*Account {
+	return p.accounts
+}
+
+func (p *AccountPool) pick() *Account {
+	start := int(p.next.Add(1) - 1)
+	var picked *Account
+	for i := range p.accounts {
+		account := p.accounts[(start+i)%len(p.accounts)]
+		if !account.Source.Ready() {
+			continue
+		}
+		if p.strategy == BalanceRoundRobin {
+			return account
+		}
+		if picked == nil || account.inFlight.Load() < picked.inFlight.Load() {
+			picked = account
+		}
+	}
+	if picked == nil {
+		// None is ready; let the first one answer with its usual 503.
+		return p.accounts[start%len(p.accounts)]
+	}
+	return picked
+}
+
+// Ready reports whether at least one account has a usable token.
+func (p *AccountPool) Ready() bool {
+	for _, account := range p.accounts {
+		if account.Source.Ready() {
+			return true
+		}
+	}
+	return false
+}
+
+// RefreshLoopStalled reports whether the refresh loop of any account has
+// stopped ticking.
+func (p *AccountPool) RefreshLoopStalled() bool {
+	for _, account := range p.accounts {
+		if account.Source.RefreshLoopStalled() {
+			return true
+		}
+	}
+	return false
+}
+
+// NewProxy returns a handler sending each request through the proxy of the
+// account chosen by the pool's strategy.
+func (p *AccountPool) NewProxy(upstreams ...*url.URL) http.Handler {
+	proxies := make([]http.Handler, len(p.accounts))
+	index := make(map[*Account]int, len(p.accounts))
+	for i, account := range p.accounts {
+		proxies[i] = account.Source.NewProxy(upstreams...)
+		index[account] = i
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		account := p.pick()
+		r, info := withRequestInfo(r)
+		info.account = account.Name
+
+		account.inFlight.Add(1)
+		defer account.inFlight.Add(-1)
+		proxies[index[account]].ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,131 @@
+package copilotproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"time"
+)
+
+func AccessTokensHandler(keys *AccessKeys) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"tokens": keys.Status(),
+		})
+	}
+}
+
+type accountRefresh struct {
+	Name      string `json:"name"`
+	ExpiresAt string `json:"expires_at,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// RefreshHandler fetches a new Copilot token for every account of pool, or
+// only for the one named by the account query parameter, and reports the
+// outcome of each. It answers 502 if any refresh failed.
+func RefreshHandler(pool *AccountPool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		accounts := pool.Accounts()
+		if name := r.URL.Query().Get("account"); name != "" {
+			accounts = nil
+			for _, account := range pool.Accounts() {
+				if account.Name == name {
+					accounts = []*Account{account}
+				}
+			}
+			if accounts == nil {
+				writeOpenAIError(w, http.StatusNotFound, "invalid_request_error", "unknown account "+name)
+				return
+			}
+		}
+
+		results := make([]accountRefresh, len(accounts))
+		var wg sync.WaitGroup
+		for i, account := range accounts {
+			wg.Go(func() {
+				results[i].Name = account.Name
+				if err := account.Source.RefreshNow(r.Context()); err != nil {
+					slog.Error("forced token refresh failed", "account", account.Name, "error", err)
+					results[i].Error = err.Error()
+					return
+				}
+				results[i].ExpiresAt = account.Source.ExpiresAt().UTC().Format(time.RFC3339)
+			})
+		}
+		wg.Wait()
+
+		code := http.StatusOK
+		for _, result := range results {
+			if result.Error != "" {
+				code = http.StatusBadGateway
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		_ = json.NewEncoder(w).Encode(map[string]any{"accounts": results})
+	}
+}
+
+var redactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "X-Api-Key"}
+
+func PreviewHandler(ts *TokenSource, upstream *url.URL) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p := r.URL.Query().Get("path")
+		if p == "" {
+			p = "/chat/completions"
+		}
+		body, err := readBody(r)
+		if err != nil {
+			writeOpenAIError(w, bodyReadStatus(err), "invalid_request_error", "failed to read request body")
+			return
+		}
+
+		in, err := http.NewRequestWithContext(r.Context(), http.MethodPost, normalizePath(p), bytes.NewReader(body))
+		if err != nil {
+			writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "invalid path: "+err.Error())
+			return
+		}
+		in.Header = r.Header.Clone()
+		in, info := withRequestInfo(in)
+		if isCompletionPath(in.URL.Path) {
+			info.stream = isStreamRequest(body)
+		}
+
+		out := in.Clone(in.Context())
+		out.Body = io.NopCloser(bytes.NewReader(body))
+		ts.rewriteRequest(&httputil.ProxyRequest{In: in, Out: out}, upstream)
+
+		outBody, err := io.ReadAll(out.Body)
+		if err != nil {
+			writeOpenAIError(w, http.StatusInternalServerError, "server_error", "failed to read rewritten body")
+			return
+		}
+		header := out.Header.Clone()
+		for _, key := range redactedHeaders {
+			if header.Get(key) != "" {
+				header.Set(key, "[REDACTED]")
+			}
+		}
+
+		preview := map[string]any{
+			"method":  out.Method,
+			"url":     out.URL.String(),
+			"headers": header,
+			"stream":  info.stream,
+		}
+		if json.Valid(outBody) {
+			preview["body"] = json.RawMessage(outBody)
+		} else {
+			preview["body"] = string(outBody)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(preview)
+	}
+}
@@ -0,0 +1,77 @@
+package copilotproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRefreshHandler(t *testing.T) {
+	tokens := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer good" {
+			http.Error(w, "bad credentials", http.StatusUnauthorized)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(APIToken{Token: "token", ExpiresAt: time.Now().Add(time.Hour).Unix(), RefreshIn: 1500})
+	}))
+	defer tokens.Close()
+
+	source := func(oauthToken string) *TokenSource {
+		ts := NewTokenSource(oauthToken)
+		ts.TokenEndpoint = tokens.URL
+		return ts
+	}
+	pool, err := NewAccountPool(BalanceRoundRobin, &Account{Name: "default", Source: source("good")}, &Account{Name: "backup", Source: source("bad")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query  string
+		want   int
+		failed []string
+		names  []string
+	}{
+		{"", http.StatusBadGateway, []string{"backup"}, []string{"default", "backup"}},
+		{"?account=default", http.StatusOK, nil, []string{"default"}},
+		{"?account=backup", http.StatusBadGateway, []string{"backup"}, []string{"backup"}},
+		{"?account=nobody", http.StatusNotFound, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			RefreshHandler(pool)(w, httptest.NewRequest(http.MethodPost, "/admin/token/refresh"+tt.query, nil))
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if tt.names == nil {
+				return
+			}
+			var body struct {
+				Accounts []accountRefresh `json:"accounts"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if len(body.Accounts) != len(tt.names) {
+				t.Fatalf("accounts = %+v, want %v", body.Accounts, tt.names)
+			}
+			var failed []string
+			for i, account := range body.Accounts {
+				if account.Name != tt.names[i] {
+					t.Errorf("accounts[%d] = %q, want %q", i, account.Name, tt.names[i])
+				}
+				if account.Error != "" {
+					failed = append(failed, account.Name)
+				} else if account.ExpiresAt == "" {
+					t.Errorf("account %s has no expires_at", account.Name)
+				}
+			}
+			if len(failed) != len(tt.failed) || (len(failed) > 0 && failed[0] != tt.failed[0]) {
+				t.Errorf("failed = %v, want %v", failed, tt.failed)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package copilotproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type alertPayload struct {
+	Event               string    `json:"event"`
+	Error               string    `json:"error,omitempty"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	Time                time.Time `json:"time"`
+}
+
+// AlertWebhook posts a JSON payload to a URL when token refreshes keep
+// failing or the token source becomes not ready.
+type AlertWebhook struct {
+	URL       string
+	Threshold int
+	Debounce  time.Duration
+	Timeout   time.Duration
+	Client    *http.Client
+
+	mu       sync.Mutex
+	failures int
+	lastErr  string
+	lastSent map[string]time.Time
+}
+
+func NewAlertWebhook(url string) *AlertWebhook {
+	return &AlertWebhook{
+		URL:       url,
+		Threshold: 3,
+		Debounce:  5 * time.Minute,
+		Timeout:   5 * time.Second,
+		Client:    http.DefaultClient,
+		lastSent:  make(map[string]time.Time),
+	}
+}
+
+func (a *AlertWebhook) RefreshFailed(err error, failures int) {
+	a.mu.Lock()
+	a.failures = failures
+	a.lastErr = err.Error()
+	a.mu.Unlock()
+
+	if failures >= a.Threshold {
+		a.send("refresh_failed")
+	}
+}
+
+func (a *AlertWebhook) RefreshSucceeded() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.failures = 0
+	a.lastErr = ""
+}
+
+func (a *AlertWebhook) ReadinessChanged(ready bool) {
+	if !ready {
+		a.send("not_ready")
+	}
+}
+
+func (a *AlertWebhook) send(event string) {
+	a.mu.Lock()
+	now := time.Now()
+	if last, ok := a.lastSent[event]; ok && now.Sub(last) < a.Debounce {
+		a.mu.Unlock()
+		return
+	}
+	a.lastSent[event] = now
+	payload := alertPayload{Event: event, Error: a.lastErr, ConsecutiveFailures: a.failures, Time: now.UTC()}
+	a.mu.Unlock()
+
+	go func() {
+		data, _ := json.Marshal(payload)
+		ctx, cancel := context.WithTimeout(context.Background(), a.Timeout)
+		defer cancel()
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.URL, bytes.NewReader(data))
+		if err != nil {
+			slog.Error("failed to create alert request", "error", err)
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		rsp, err := a.Client.Do(req)
+		if err != nil {
+			slog.Error("failed to send alert", "event", event, "error", err)
+			return
+		}
+		_ = rsp.Body.Close()
+		if rsp.StatusCode >= 300 {
+			slog.Error("alert webhook rejected alert", "event", event, "status", rsp.StatusCode)
+		}
+	}()
+}
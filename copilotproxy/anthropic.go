@@ -0,0 +1,722 @@
+package copilotproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const maxTranslatedBodyBytes = 32 << 20
+
+type anthropicRequest struct {
+	Model         string             `json:"model"`
+	MaxTokens     int                `json:"max_tokens,omitempty"`
+	System        json.RawMessage    `json:"system,omitempty"`
+	Messages      []anthropicMessage `json:"messages"`
+	StopSequences []string           `json:"stop_sequences,omitempty"`
+	Stream        bool               `json:"stream,omitempty"`
+	Temperature   *float64           `json:"temperature,omitempty"`
+	TopP          *float64           `json:"top_p,omitempty"`
+	Tools         []anthropicTool    `json:"tools,omitempty"`
+	ToolChoice    *struct {
+		Type string `json:"type"`
+		Name string `json:"name,omitempty"`
+	} `json:"tool_choice,omitempty"`
+	Metadata *struct {
+		UserID string `json:"user_id,omitempty"`
+	} `json:"metadata,omitempty"`
+}
+
+type anthropicMessage struct {
+	Role    string          `json:"role"`
+	Content json.RawMessage `json:"content"`
+}
+
+type anthropicBlock struct {
+	Type      string          `json:"type"`
+	Text      string          `json:"text,omitempty"`
+	ID        string          `json:"id,omitempty"`
+	Name      string          `json:"name,omitempty"`
+	Input     json.RawMessage `json:"input,omitempty"`
+	ToolUseID string          `json:"tool_use_id,omitempty"`
+	Content   json.RawMessage `json:"content,omitempty"`
+	IsError   bool            `json:"is_error,omitempty"`
+	Source    *struct {
+		Type      string `json:"type"`
+		MediaType string `json:"media_type,omitempty"`
+		Data      string `json:"data,omitempty"`
+		URL       string `json:"url,omitempty"`
+	} `json:"source,omitempty"`
+}
+
+type anthropicTool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	InputSchema json.RawMessage `json:"input_schema"`
+}
+
+type chatMessage struct {
+	Role       string         `json:"role"`
+	Content    any            `json:"content"`
+	ToolCalls  []chatToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string         `json:"tool_call_id,omitempty"`
+}
+
+type chatPart struct {
+	Type     string `json:"type"`
+	Text     string `json:"text,omitempty"`
+	ImageURL *struct {
+		URL string `json:"url"`
+	} `json:"image_url,omitempty"`
+}
+
+type chatToolCall struct {
+	Index    *int   `json:"index,omitempty"`
+	ID       string `json:"id,omitempty"`
+	Type     string `json:"type,omitempty"`
+	Function struct {
+		Name      string `json:"name,omitempty"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+// parseBlocks accepts Anthropic content given either as a string or as an
+// array of blocks.
+func parseBlocks(content json.RawMessage) ([]anthropicBlock, error) {
+	if len(content) == 0 || string(content) == "null" {
+		return nil, nil
+	}
+	var text string
+	if err := json.Unmarshal(content, &text); err == nil {
+		return []anthropicBlock{{Type: "text", Text: text}}, nil
+	}
+	var blocks []anthropicBlock
+	if err := json.Unmarshal(content, &blocks); err != nil {
+		return nil, fmt.Errorf("content must be a string or an array of content blocks")
+	}
+	return blocks, nil
+}
+
+func blocksText(content json.RawMessage) (string, error) {
+	blocks, err := parseBlocks(content)
+	if err != nil {
+		return "", err
+	}
+	var texts []string
+	for _, block := range blocks {
+		if block.Type == "text" {
+			texts = append(texts, block.Text)
+		}
+	}
+	return strings.Join(texts, "\n"), nil
+}
+
+// translateAnthropicRequest turns a Messages API request into a chat
+// completions request.
+func translateAnthropicRequest(req *anthropicRequest) (map[string]any, error) {
+	var messages []chatMessage
+	if len(req.System) > 0 {
+		system, err := blocksText(req.System)
+		if err != nil {
+			return nil, fmt.Errorf("system: %w", err)
+		}
+		if system != "" {
+			messages = append(messages, chatMessage{Role: "system", Content: system})
+		}
+	}
+	for i, msg := range req.Messages {
+		blocks, err := parseBlocks(msg.Content)
+		if err != nil {
+			return nil, fmt.Errorf("messages[%d]: %w", i, err)
+		}
+		var parts []chatPart
+		var toolCalls []chatToolCall
+		for _, block := range blocks {
+			switch block.Type {
+			case "text":
+				parts = append(parts, chatPart{Type: "text", Text: block.Text})
+			case "image":
+				if block.Source == nil {
+					continue
+				}
+				part := chatPart{Type: "image_url", ImageURL: &struct {
+					URL string `json:"url"`
+				}{URL: block.Source.URL}}
+				if block.Source.Type == "base64" {
+					part.ImageURL.URL = "data:" + block.Source.MediaType + ";base64," + block.Source.Data
+				}
+				parts = append(parts, part)
+			case "tool_use":
+				call := chatToolCall{ID: block.ID, Type: "function"}
+				call.Function.Name = block.Name
+				call.Function.Arguments = "{}"
+				if len(block.Input) > 0 {
+					call.Function.Arguments = string(block.Input)
+				}
+				toolCalls = append(toolCalls, call)
+			case "tool_result":
+				result, err := blocksText(block.Content)
+				if err != nil {
+					return nil, fmt.Errorf("messages[%d]: tool_result: %w", i, err)
+				}
+				if block.IsError {
+					result = "Error: " + result
+				}
+				messages = append(messages, chatMessage{Role: "tool", ToolCallID: block.ToolUseID, Content: result})
+			}
+		}
+		if len(parts) == 0 && len(toolCalls) == 0 {
+			continue
+		}
+		out := chatMessage{Role: msg.Role, ToolCalls: toolCalls}
+		switch {
+		case len(parts) == 0:
+			out.Content = nil
+		case msg.Role == "assistant" || (len(parts) == 1 && parts[0].Type == "text"):
+			var texts []string
+			for _, part := range parts {
+				texts = append(texts, part.Text)
+			}
+			out.Content = strings.Join(texts, "")
+		default:
+			out.Content = parts
+		}
+		messages = append(messages, out)
+	}
+
+	out := map[string]any{
+		"model":    req.Model,
+		"messages": messages,
+	}
+	if req.MaxTokens > 0 {
+		out["max_tokens"] = req.MaxTokens
+	}
+	if len(req.StopSequences) > 0 {
+		out["stop"] = req.StopSequences
+	}
+	if req.Temperature != nil {
+		out["temperature"] = *req.Temperature
+	}
+	if req.TopP != nil {
+		out["top_p"] = *req.TopP
+	}
+	if req.Stream {
+		out["stream"] = true
+		out["stream_options"] = map[string]any{"include_usage": true}
+	}
+	if req.Metadata != nil && req.Metadata.UserID != "" {
+		out["user"] = req.Metadata.UserID
+	}
+	if len(req.Tools) > 0 {
+		tools := make([]map[string]any, 0, len(req.Tools))
+		for _, tool := range req.Tools {
+			function := map[string]any{"name": tool.Name}
+			if tool.Description != "" {
+				function["description"] = tool.Description
+			}
+			if len(tool.InputSchema) > 0 {
+				function["parameters"] = tool.InputSchema
+			}
+			tools = append(tools, map[string]any{"type": "function", "function": function})
+		}
+		out["tools"] = tools
+	}
+	if req.ToolChoice != nil {
+		switch req.ToolChoice.Type {
+		case "auto":
+			out["tool_choice"] = "auto"
+		case "any":
+			out["tool_choice"] = "required"
+		case "none":
+			out["tool_choice"] = "none"
+		case "tool":
+			out["tool_choice"] = map[string]any{"type": "function", "function": map[string]any{"name": req.ToolChoice.Name}}
+		}
+	}
+	return out, nil
+}
+
+type chatUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+}
+
+type chatCompletion struct {
+	ID      string `json:"id"`
+	Model   string `json:"model"`
+	Choices []struct {
+		Message struct {
+			Content   *string        `json:"content"`
+			ToolCalls []chatToolCall `json:"tool_calls"`
+		} `json:"message"`
+		Delta struct {
+			Content   *string        `json:"content"`
+			ToolCalls []chatToolCall `json:"tool_calls"`
+		} `json:"delta"`
+		FinishReason *string `json:"finish_reason"`
+	} `json:"choices"`
+	Usage *chatUsage       `json:"usage"`
+	Error *openAIErrorBody `json:"error"`
+}
+
+func anthropicStopReason(finishReason string) string {
+	switch finishReason {
+	case "length":
+		return "max_tokens"
+	case "tool_calls", "function_call":
+		return "tool_use"
+	default:
+		return "end_turn"
+	}
+}
+
+func anthropicUsage(usage *chatUsage) map[string]int {
+	if usage == nil {
+		return map[string]int{"input_tokens": 0, "output_tokens": 0}
+	}
+	return map[string]int{"input_tokens": usage.PromptTokens, "output_tokens": usage.CompletionTokens}
+}
+
+func toolInput(arguments string) json.RawMessage {
+	if json.Valid([]byte(arguments)) && strings.TrimSpace(arguments) != "" {
+		return json.RawMessage(arguments)
+	}
+	return json.RawMessage("{}")
+}
+
+func translateChatCompletion(body []byte, model string) ([]byte, error) {
+	var completion chatCompletion
+	if err := json.Unmarshal(body, &completion); err != nil {
+		return nil, fmt.Errorf("failed to parse upstream response: %w", err)
+	}
+	content := []map[string]any{}
+	stopReason := "end_turn"
+	for _, choice := range completion.Choices {
+		if text := choice.Message.Content; text != nil && *text != "" {
+			content = append(content, map[string]any{"type": "text", "text": *text})
+		}
+		for _, call := range choice.Message.ToolCalls {
+			content = append(content, map[string]any{"type": "tool_use", "id": call.ID, "name": call.Function.Name, "input": toolInput(call.Function.Arguments)})
+		}
+		if choice.FinishReason != nil {
+			stopReason = anthropicStopReason(*choice.FinishReason)
+		}
+	}
+	if completion.Model != "" {
+		model = completion.Model
+	}
+	return json.Marshal(map[string]any{
+		"id":            completion.ID,
+		"type":          "message",
+		"role":          "assistant",
+		"model":         model,
+		"content":       content,
+		"stop_reason":   stopReason,
+		"stop_sequence": nil,
+		"usage":         anthropicUsage(completion.Usage),
+	})
+}
+
+func anthropicErrorType(code int) string {
+	switch {
+	case code == http.StatusBadRequest:
+		return "invalid_request_error"
+	case code == http.StatusUnauthorized:
+		return "authentication_error"
+	case code == http.StatusForbidden:
+		return "permission_error"
+	case code == http.StatusNotFound:
+		return "not_found_error"
+	case code == http.StatusRequestEntityTooLarge:
+		return "request_too_large"
+	case code == http.StatusTooManyRequests:
+		return "rate_limit_error"
+	case code == http.StatusServiceUnavailable || code == 529:
+		return "overloaded_error"
+	case code >= 500:
+		return "api_error"
+	default:
+		return "invalid_request_error"
+	}
+}
+
+func anthropicErrorBody(typ, message string) []byte {
+	data, _ := json.Marshal(map[string]any{"type": "error", "error": map[string]string{"type": typ, "message": message}})
+	return data
+}
+
+func writeAnthropicError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	_, _ = w.Write(anthropicErrorBody(anthropicErrorType(code), message))
+}
+
+// upstreamErrorMessage extracts the message of an OpenAI-style error, or
+// falls back to the body itself.
+func upstreamErrorMessage(body []byte) string {
+	var payload openAIError
+	if err := json.Unmarshal(body, &payload); err == nil && payload.Error.Message != "" {
+		return payload.Error.Message
+	}
+	if message := strings.TrimSpace(string(body)); message != "" {
+		return message
+	}
+	return "upstream request failed"
+}
+
+// anthropicWriter receives the chat completions response from the API
+// handler and writes it to the client in the Messages API format.
+type anthropicWriter struct {
+	w      http.ResponseWriter
+	header http.Header
+	code   int
+	model  string
+
+	streaming bool
+	buf       bytes.Buffer
+	stream    *anthropicStream
+}
+
+func (aw *anthropicWriter) Header() http.Header {
+	return aw.header
+}
+
+func (aw *anthropicWriter) WriteHeader(code int) {
+	if aw.code != 0 {
+		return
+	}
+	aw.code = code
+	if code == http.StatusOK && isEventStream(aw.header) {
+		aw.streaming = true
+		aw.copyHeaders()
+		aw.w.Header().Set("Content-Type", "text/event-stream")
+		aw.w.Header().Set("Cache-Control", "no-cache")
+		aw.w.WriteHeader(http.StatusOK)
+		aw.stream = &anthropicStream{w: aw.w, model: aw.model}
+	}
+}
+
+func (aw *anthropicWriter) Write(b []byte) (int, error) {
+	if aw.code == 0 {
+		aw.WriteHeader(http.StatusOK)
+	}
+	if aw.streaming {
+		if err := aw.stream.feed(b); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	return aw.buf.Write(b)
+}
+
+func (aw *anthropicWriter) Flush() {
+	if aw.streaming {
+		_ = http.NewResponseController(aw.w).Flush()
+	}
+}
+
+func (aw *anthropicWriter) copyHeaders() {
+	copyTranslatedHeaders(aw.w.Header(), aw.header)
+}
+
+// copyTranslatedHeaders passes on the upstream headers that still apply
+// once the body has been translated to another format.
+func copyTranslatedHeaders(dst, src http.Header) {
+	for k, v := range src {
+		switch http.CanonicalHeaderKey(k) {
+		case "Content-Length", "Content-Type", "Content-Encoding", "Transfer-Encoding", "Etag":
+			continue
+		}
+		dst[k] = v
+	}
+}
+
+// sseData splits a chat completions event stream into the payloads of its
+// data lines, which may arrive in arbitrary pieces.
+type sseData struct {
+	pending []byte
+}
+
+func (d *sseData) feed(b []byte, fn func(data string) error) error {
+	d.pending = append(d.pending, b...)
+	for {
+		i := bytes.IndexByte(d.pending, '\n')
+		if i < 0 {
+			return nil
+		}
+		line := strings.TrimRight(string(d.pending[:i]), "\r")
+		d.pending = d.pending[i+1:]
+		data, ok := strings.CutPrefix(line, "data:")
+		if !ok {
+			continue
+		}
+		if err := fn(strings.TrimSpace(data)); err != nil {
+			return err
+		}
+	}
+}
+
+func (d *sseData) flush(fn func(data string) error) error {
+	if len(d.pending) == 0 {
+		return nil
+	}
+	return d.feed([]byte("\n"), fn)
+}
+
+func (aw *anthropicWriter) finish() {
+	if aw.code == 0 {
+		aw.code = http.StatusOK
+	}
+	if aw.streaming {
+		aw.stream.close()
+		return
+	}
+	aw.copyHeaders()
+	if aw.code != http.StatusOK {
+		writeAnthropicError(aw.w, aw.code, upstreamErrorMessage(aw.buf.Bytes()))
+		return
+	}
+	body, err := translateChatCompletion(aw.buf.Bytes(), aw.model)
+	if err != nil {
+		writeAnthropicError(aw.w, http.StatusBadGateway, err.Error())
+		return
+	}
+	aw.w.Header().Set("Content-Type", "application/json")
+	aw.w.WriteHeader(http.StatusOK)
+	_, _ = aw.w.Write(body)
+}
+
+// anthropicStream converts chat completion chunks into Messages API
+// streaming events.
+type anthropicStream struct {
+	w     http.ResponseWriter
+	model string
+
+	data       sseData
+	started    bool
+	done       bool
+	blocks     int
+	open       string
+	toolBlocks map[int]int
+	stopReason string
+	usage      *chatUsage
+}
+
+func (s *anthropicStream) event(name string, payload any) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", name, data); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *anthropicStream) feed(b []byte) error {
+	return s.data.feed(b, s.chunk)
+}
+
+func (s *anthropicStream) start(id string) error {
+	if s.started {
+		return nil
+	}
+	s.started = true
+	s.toolBlocks = make(map[int]int)
+	return s.event("message_start", map[string]any{
+		"type": "message_start",
+		"message": map[string]any{
+			"id":            id,
+			"type":          "message",
+			"role":          "assistant",
+			"model":         s.model,
+			"content":       []any{},
+			"stop_reason":   nil,
+			"stop_sequence": nil,
+			"usage":         anthropicUsage(nil),
+		},
+	})
+}
+
+func (s *anthropicStream) closeBlock() error {
+	if s.open == "" {
+		return nil
+	}
+	s.open = ""
+	return s.event("content_block_stop", map[string]any{"type": "content_block_stop", "index": s.blocks - 1})
+}
+
+func (s *anthropicStream) openBlock(kind string, block map[string]any) error {
+	if err := s.closeBlock(); err != nil {
+		return err
+	}
+	s.open = kind
+	s.blocks++
+	return s.event("content_block_start", map[string]any{"type": "content_block_start", "index": s.blocks - 1, "content_block": block})
+}
+
+func (s *anthropicStream) chunk(data string) error {
+	if s.done || data == "" {
+		return nil
+	}
+	if data == "[DONE]" {
+		return s.stop()
+	}
+	var chunk chatCompletion
+	if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+		return nil
+	}
+	if chunk.Error != nil {
+		s.done = true
+		return s.event("error", json.RawMessage(anthropicErrorBody("api_error", chunk.Error.Message)))
+	}
+	if chunk.Model != "" && !s.started {
+		s.model = chunk.Model
+	}
+	if err := s.start(chunk.ID); err != nil {
+		return err
+	}
+	if chunk.Usage != nil {
+		s.usage = chunk.Usage
+	}
+	for _, choice := range chunk.Choices {
+		if text := choice.Delta.Content; text != nil && *text != "" {
+			if s.open != "text" {
+				if err := s.openBlock("text", map[string]any{"type": "text", "text": ""}); err != nil {
+					return err
+				}
+			}
+			if err := s.event("content_block_delta", map[string]any{"type": "content_block_delta", "index": s.blocks - 1, "delta": map[string]any{"type": "text_delta", "text": *text}}); err != nil {
+				return err
+			}
+		}
+		for _, call := range choice.Delta.ToolCalls {
+			index := 0
+			if call.Index != nil {
+				index = *call.Index
+			}
+			block, ok := s.toolBlocks[index]
+			if !ok {
+				if err := s.openBlock("tool_use", map[string]any{"type": "tool_use", "id": call.ID, "name": call.Function.Name, "input": map[string]any{}}); err != nil {
+					return err
+				}
+				block = s.blocks - 1
+				s.toolBlocks[index] = block
+			}
+			// Arguments of a tool call whose block is already closed cannot
+			// be sent any more.
+			if call.Function.Arguments != "" && block == s.blocks-1 && s.open == "tool_use" {
+				if err := s.event("content_block_delta", map[string]any{"type": "content_block_delta", "index": block, "delta": map[string]any{"type": "input_json_delta", "partial_json": call.Function.Arguments}}); err != nil {
+					return err
+				}
+			}
+		}
+		if choice.FinishReason != nil && *choice.FinishReason != "" {
+			s.stopReason = anthropicStopReason(*choice.FinishReason)
+		}
+	}
+	return nil
+}
+
+func (s *anthropicStream) stop() error {
+	if s.done {
+		return nil
+	}
+	if err := s.start(""); err != nil {
+		return err
+	}
+	s.done = true
+	if err := s.closeBlock(); err != nil {
+		return err
+	}
+	stopReason := s.stopReason
+	if stopReason == "" {
+		stopReason = "end_turn"
+	}
+	usage := anthropicUsage(s.usage)
+	if err := s.event("message_delta", map[string]any{
+		"type":  "message_delta",
+		"delta": map[string]any{"stop_reason": stopReason, "stop_sequence": nil},
+		"usage": map[string]int{"input_tokens": usage["input_tokens"], "output_tokens": usage["output_tokens"]},
+	}); err != nil {
+		return err
+	}
+	return s.event("message_stop", map[string]any{"type": "message_stop"})
+}
+
+func (s *anthropicStream) close() {
+	_ = s.data.flush(s.chunk)
+	_ = s.stop()
+	_ = http.NewResponseController(s.w).Flush()
+}
+
+// AnthropicAPIKey accepts the access token of Anthropic clients, sent as an
+// x-api-key header, in place of a bearer token. It must run before auth.
+func AnthropicAPIKey(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if key := r.Header.Get("X-Api-Key"); key != "" {
+			if r.Header.Get("Authorization") == "" {
+				r.Header.Set("Authorization", "Bearer "+key)
+			}
+			r.Header.Del("X-Api-Key")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// AnthropicMessages serves the Anthropic Messages API on top of api, which
+// must accept chat completions requests at path. Requests and responses,
+// including streamed ones, are translated between the two formats. Auth and
+// the body limit are expected to run in front of it, as the request is read
+// before any of the api chain does.
+func AnthropicMessages(api http.Handler, path string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxTranslatedBodyBytes))
+		if err != nil {
+			writeAnthropicError(w, bodyReadStatus(err), "failed to read request body")
+			return
+		}
+		if coding := r.Header.Get("Content-Encoding"); coding != "" {
+			if body, err = decodeBody(coding, body, maxTranslatedBodyBytes); err != nil {
+				writeAnthropicError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+		var req anthropicRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			writeAnthropicError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+			return
+		}
+		if req.Model == "" || len(req.Messages) == 0 {
+			writeAnthropicError(w, http.StatusBadRequest, "model and messages are required")
+			return
+		}
+		translated, err := translateAnthropicRequest(&req)
+		if err != nil {
+			writeAnthropicError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		data, err := json.Marshal(translated)
+		if err != nil {
+			writeAnthropicError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		out := r.Clone(r.Context())
+		out.URL.Path = path
+		out.URL.RawPath = ""
+		out.Body = io.NopCloser(bytes.NewReader(data))
+		out.ContentLength = int64(len(data))
+		out.Header.Set("Content-Type", "application/json")
+		out.Header.Del("Content-Encoding")
+		out.Header.Del("Accept-Encoding")
+
+		aw := &anthropicWriter{w: w, header: make(http.Header), model: req.Model}
+		api.ServeHTTP(aw, out)
+		aw.finish()
+	})
+}
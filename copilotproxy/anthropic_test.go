@@ -0,0 +1,259 @@
+package copilotproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestAnthropicMessagesAuthBeforeRead(t *testing.T) {
+	keys, err := NewAccessKeys(&AccessKey{Name: "alice", Token: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var called bool
+	api := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		if got := r.Header.Get("Authorization"); got != "Bearer secret" {
+			t.Errorf("Authorization = %q, want the x-api-key as bearer token", got)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id":"1","model":"gpt-4o","choices":[{"message":{"role":"assistant","content":"hi"},"finish_reason":"stop"}]}`))
+	})
+	handler := ApplyMiddlewares(AnthropicMessages(api, "/chat/completions"), AnthropicAPIKey, TrackRequestInfo, VerifyAccessToken(keys, nil), LimitBody(128))
+	body := `{"model":"gpt-4o","max_tokens":10,"messages":[{"role":"user","content":"hello"}]}`
+
+	tests := []struct {
+		name   string
+		header http.Header
+		body   string
+		want   int
+	}{
+		{"no key", nil, body, http.StatusUnauthorized},
+		{"wrong key", http.Header{"X-Api-Key": {"nope"}}, body, http.StatusUnauthorized},
+		{"body too large", http.Header{"X-Api-Key": {"secret"}}, body + strings.Repeat(" ", 128), http.StatusRequestEntityTooLarge},
+		{"x-api-key", http.Header{"X-Api-Key": {"secret"}}, body, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			called = false
+			r := httptest.NewRequest(http.MethodPost, "/anthropic/v1/messages", strings.NewReader(tt.body))
+			for name, values := range tt.header {
+				r.Header[name] = values
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if called != (tt.want == http.StatusOK) {
+				t.Errorf("api called = %v", called)
+			}
+		})
+	}
+}
+
+func TestTranslateAnthropicRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		req     string
+		want    string
+		wantErr string
+	}{
+		{
+			name: "system string",
+			req:  `{"model":"claude","max_tokens":100,"system":"Be brief.","messages":[{"role":"user","content":"Hello"}]}`,
+			want: `{"model":"claude","max_tokens":100,"messages":[{"role":"system","content":"Be brief."},{"role":"user","content":"Hello"}]}`,
+		},
+		{
+			name: "system blocks",
+			req:  `{"model":"claude","system":[{"type":"text","text":"A"},{"type":"text","text":"B"}],"messages":[{"role":"user","content":[{"type":"text","text":"Hello"}]}]}`,
+			want: `{"model":"claude","messages":[{"role":"system","content":"A\nB"},{"role":"user","content":"Hello"}]}`,
+		},
+		{
+			name: "tool use and tool result",
+			req: `{"model":"claude","messages":[
+				{"role":"user","content":"Weather?"},
+				{"role":"assistant","content":[{"type":"text","text":"Checking."},{"type":"tool_use","id":"toolu_1","name":"get_weather","input":{"city":"Paris"}}]},
+				{"role":"user","content":[{"type":"tool_result","tool_use_id":"toolu_1","content":[{"type":"text","text":"Sunny"}]},{"type":"tool_result","tool_use_id":"toolu_2","content":"timeout","is_error":true}]}]}`,
+			want: `{"model":"claude","messages":[
+				{"role":"user","content":"Weather?"},
+				{"role":"assistant","content":"Checking.","tool_calls":[{"id":"toolu_1","type":"function","function":{"name":"get_weather","arguments":"{\"city\":\"Paris\"}"}}]},
+				{"role":"tool","tool_call_id":"toolu_1","content":"Sunny"},
+				{"role":"tool","tool_call_id":"toolu_2","content":"Error: timeout"}]}`,
+		},
+		{
+			name: "tool use without text or input",
+			req:  `{"model":"claude","messages":[{"role":"assistant","content":[{"type":"tool_use","id":"toolu_1","name":"now"}]}]}`,
+			want: `{"model":"claude","messages":[{"role":"assistant","content":null,"tool_calls":[{"id":"toolu_1","type":"function","function":{"name":"now","arguments":"{}"}}]}]}`,
+		},
+		{
+			name: "images",
+			req: `{"model":"claude","messages":[{"role":"user","content":[
+				{"type":"text","text":"Describe"},
+				{"type":"image","source":{"type":"base64","media_type":"image/png","data":"iVBOR"}},
+				{"type":"image","source":{"type":"url","url":"https://example.com/cat.jpg"}}]}]}`,
+			want: `{"model":"claude","messages":[{"role":"user","content":[
+				{"type":"text","text":"Describe"},
+				{"type":"image_url","image_url":{"url":"data:image/png;base64,iVBOR"}},
+				{"type":"image_url","image_url":{"url":"https://example.com/cat.jpg"}}]}]}`,
+		},
+		{
+			name: "tools and tool_choice any",
+			req:  `{"model":"claude","stream":true,"tools":[{"name":"get_weather","description":"Look up the weather","input_schema":{"type":"object"}}],"tool_choice":{"type":"any"},"messages":[{"role":"user","content":"Hi"}]}`,
+			want: `{"model":"claude","stream":true,"stream_options":{"include_usage":true},"tools":[{"type":"function","function":{"name":"get_weather","description":"Look up the weather","parameters":{"type":"object"}}}],"tool_choice":"required","messages":[{"role":"user","content":"Hi"}]}`,
+		},
+		{
+			name: "tool_choice tool",
+			req:  `{"model":"claude","tool_choice":{"type":"tool","name":"get_weather"},"messages":[{"role":"user","content":"Hi"}]}`,
+			want: `{"model":"claude","tool_choice":{"type":"function","function":{"name":"get_weather"}},"messages":[{"role":"user","content":"Hi"}]}`,
+		},
+		{
+			name:    "invalid content",
+			req:     `{"model":"claude","messages":[{"role":"user","content":42}]}`,
+			wantErr: "messages[0]: content must be a string or an array of content blocks",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var req anthropicRequest
+			if err := json.Unmarshal([]byte(tt.req), &req); err != nil {
+				t.Fatal(err)
+			}
+			out, err := translateAnthropicRequest(&req)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertJSONEqual(t, out, tt.want)
+		})
+	}
+}
+
+// assertJSONEqual compares got, once marshaled, with the JSON want
+// regardless of key order and whitespace.
+func assertJSONEqual(t *testing.T, got any, want string) {
+	t.Helper()
+	data, err := json.Marshal(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gotValue, wantValue any
+	if err := json.Unmarshal(data, &gotValue); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(want), &wantValue); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gotValue, wantValue) {
+		t.Errorf("got %s\nwant %s", data, want)
+	}
+}
+
+// feedInPieces feeds the chat completions event stream of chunks to feed
+// a few bytes at a time, so events are split across writes.
+func feedInPieces(t *testing.T, feed func([]byte) error, chunks ...string) {
+	t.Helper()
+	var stream strings.Builder
+	for _, chunk := range chunks {
+		stream.WriteString("data: " + chunk + "\n\n")
+	}
+	data := []byte(stream.String())
+	for len(data) > 0 {
+		n := min(7, len(data))
+		if err := feed(data[:n]); err != nil {
+			t.Fatal(err)
+		}
+		data = data[n:]
+	}
+}
+
+func TestAnthropicStream(t *testing.T) {
+	tests := []struct {
+		name   string
+		chunks []string
+		want   []string
+	}{
+		{
+			name: "text and tool use",
+			chunks: []string{
+				`{"id":"chatcmpl-1","model":"gpt-4o","choices":[{"index":0,"delta":{"role":"assistant","content":"Hi"}}]}`,
+				`{"id":"chatcmpl-1","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"id":"call_1","type":"function","function":{"name":"get_weather","arguments":""}}]}}]}`,
+				`{"id":"chatcmpl-1","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"{\"city\":"}}]}}]}`,
+				`{"id":"chatcmpl-1","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"\"Paris\"}"}}]}}]}`,
+				`{"id":"chatcmpl-1","choices":[{"index":0,"delta":{},"finish_reason":"tool_calls"}]}`,
+				`{"id":"chatcmpl-1","choices":[],"usage":{"prompt_tokens":10,"completion_tokens":5}}`,
+				`[DONE]`,
+			},
+			want: []string{
+				`message_start {"message":{"content":[],"id":"chatcmpl-1","model":"gpt-4o","role":"assistant","stop_reason":null,"stop_sequence":null,"type":"message","usage":{"input_tokens":0,"output_tokens":0}},"type":"message_start"}`,
+				`content_block_start {"content_block":{"text":"","type":"text"},"index":0,"type":"content_block_start"}`,
+				`content_block_delta {"delta":{"text":"Hi","type":"text_delta"},"index":0,"type":"content_block_delta"}`,
+				`content_block_stop {"index":0,"type":"content_block_stop"}`,
+				`content_block_start {"content_block":{"id":"call_1","input":{},"name":"get_weather","type":"tool_use"},"index":1,"type":"content_block_start"}`,
+				`content_block_delta {"delta":{"partial_json":"{\"city\":","type":"input_json_delta"},"index":1,"type":"content_block_delta"}`,
+				`content_block_delta {"delta":{"partial_json":"\"Paris\"}","type":"input_json_delta"},"index":1,"type":"content_block_delta"}`,
+				`content_block_stop {"index":1,"type":"content_block_stop"}`,
+				`message_delta {"delta":{"stop_reason":"tool_use","stop_sequence":null},"type":"message_delta","usage":{"input_tokens":10,"output_tokens":5}}`,
+				`message_stop {"type":"message_stop"}`,
+			},
+		},
+		{
+			name: "no DONE",
+			chunks: []string{
+				`{"id":"chatcmpl-2","model":"gpt-4o","choices":[{"index":0,"delta":{"content":"Hi"},"finish_reason":"length"}]}`,
+			},
+			want: []string{
+				`message_start {"message":{"content":[],"id":"chatcmpl-2","model":"gpt-4o","role":"assistant","stop_reason":null,"stop_sequence":null,"type":"message","usage":{"input_tokens":0,"output_tokens":0}},"type":"message_start"}`,
+				`content_block_start {"content_block":{"text":"","type":"text"},"index":0,"type":"content_block_start"}`,
+				`content_block_delta {"delta":{"text":"Hi","type":"text_delta"},"index":0,"type":"content_block_delta"}`,
+				`content_block_stop {"index":0,"type":"content_block_stop"}`,
+				`message_delta {"delta":{"stop_reason":"max_tokens","stop_sequence":null},"type":"message_delta","usage":{"input_tokens":0,"output_tokens":0}}`,
+				`message_stop {"type":"message_stop"}`,
+			},
+		},
+		{
+			name: "upstream error",
+			chunks: []string{
+				`{"id":"chatcmpl-3","model":"gpt-4o","choices":[{"index":0,"delta":{"content":"Hi"}}]}`,
+				`{"error":{"message":"upstream overloaded"}}`,
+				`[DONE]`,
+			},
+			want: []string{
+				`message_start {"message":{"content":[],"id":"chatcmpl-3","model":"gpt-4o","role":"assistant","stop_reason":null,"stop_sequence":null,"type":"message","usage":{"input_tokens":0,"output_tokens":0}},"type":"message_start"}`,
+				`content_block_start {"content_block":{"text":"","type":"text"},"index":0,"type":"content_block_start"}`,
+				`content_block_delta {"delta":{"text":"Hi","type":"text_delta"},"index":0,"type":"content_block_delta"}`,
+				`error {"error":{"message":"upstream overloaded","type":"api_error"},"type":"error"}`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			stream := &anthropicStream{w: w, model: "claude"}
+			feedInPieces(t, stream.feed, tt.chunks...)
+			stream.close()
+
+			var got []string
+			for _, event := range strings.Split(strings.TrimSuffix(w.Body.String(), "\n\n"), "\n\n") {
+				name, data, ok := strings.Cut(event, "\ndata: ")
+				if !ok {
+					t.Fatalf("malformed event %q", event)
+				}
+				got = append(got, strings.TrimPrefix(name, "event: ")+" "+data)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("events:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
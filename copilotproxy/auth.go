@@ -0,0 +1,301 @@
+package copilotproxy
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+type BasicCredential struct {
+	User     string
+	Password string
+}
+
+func ParseBasicCredentials(values []string) ([]BasicCredential, error) {
+	creds := make([]BasicCredential, 0, len(values))
+	for _, value := range values {
+		user, password, ok := strings.Cut(value, ":")
+		if !ok || user == "" || password == "" {
+			return nil, fmt.Errorf("invalid basic auth credential %q, expected user:pass", user)
+		}
+		creds = append(creds, BasicCredential{User: user, Password: password})
+	}
+	return creds, nil
+}
+
+func secureCompare(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+type AccessKey struct {
+	Name   string
+	Token  string
+	Scopes []string
+
+	paths    []PathRule
+	lastUsed time.Time
+	requests int64
+}
+
+type AccessKeys struct {
+	mu   sync.Mutex
+	keys []*AccessKey
+}
+
+func NewAccessKeys(keys ...*AccessKey) (*AccessKeys, error) {
+	if err := checkAccessKeyNames(keys); err != nil {
+		return nil, err
+	}
+	return &AccessKeys{keys: keys}, nil
+}
+
+func checkAccessKeyNames(keys []*AccessKey) error {
+	seen := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if seen[key.Name] {
+			return fmt.Errorf("duplicate access token name %q", key.Name)
+		}
+		seen[key.Name] = true
+	}
+	return nil
+}
+
+// Replace swaps in a new set of keys. Usage of a key whose name and token
+// are unchanged carries over.
+func (k *AccessKeys) Replace(keys ...*AccessKey) error {
+	if err := checkAccessKeyNames(keys); err != nil {
+		return err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	for _, key := range keys {
+		for _, old := range k.keys {
+			if old.Name == key.Name && secureCompare(old.Token, key.Token) {
+				key.lastUsed, key.requests = old.lastUsed, old.requests
+			}
+		}
+	}
+	k.keys = keys
+	return nil
+}
+
+func ParseAccessTokensFile(file string) ([]*AccessKey, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read access tokens file: %w", err)
+	}
+	var keys []*AccessKey
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, err := ParseAccessKey(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", file, i+1, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// ParseAccessKey parses a name:token[:scopes] access token.
+func ParseAccessKey(value string) (*AccessKey, error) {
+	fields := strings.SplitN(value, ":", 3)
+	if len(fields) < 2 || fields[0] == "" || fields[1] == "" {
+		return nil, errors.New("invalid access token, expected name:token[:scopes]")
+	}
+	key := &AccessKey{Name: fields[0], Token: fields[1]}
+	if len(fields) == 3 {
+		if err := key.setScopes(strings.Split(fields[2], ",")); err != nil {
+			return nil, err
+		}
+	}
+	return key, nil
+}
+
+var scopePaths = map[string]string{
+	"chat":       "/chat/completions",
+	"embeddings": "/embeddings",
+	"models":     "/models",
+}
+
+func (key *AccessKey) setScopes(scopes []string) error {
+	patterns := make([]string, 0, len(scopes))
+	for _, scope := range scopes {
+		scope = strings.TrimSpace(scope)
+		if scope == "" {
+			continue
+		}
+		if strings.HasPrefix(scope, "/") {
+			patterns = append(patterns, scope)
+		} else if p, ok := scopePaths[scope]; ok {
+			patterns = append(patterns, p)
+		} else {
+			return fmt.Errorf("unknown scope %q", scope)
+		}
+		key.Scopes = append(key.Scopes, scope)
+	}
+	paths, err := ParsePathRules(patterns)
+	if err != nil {
+		return err
+	}
+	key.paths = paths
+	return nil
+}
+
+func (key *AccessKey) Allows(p string) bool {
+	return len(key.paths) == 0 || matchAnyPath(key.paths, path.Clean(normalizePath(p)))
+}
+
+func (k *AccessKeys) Len() int {
+	if k == nil {
+		return 0
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	return len(k.keys)
+}
+
+// Match returns the key of token and records its use, or nil.
+func (k *AccessKeys) Match(token string) *AccessKey {
+	return k.match(token, true)
+}
+
+func (k *AccessKeys) match(token string, record bool) *AccessKey {
+	if k == nil {
+		return nil
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	var matched *AccessKey
+	for _, key := range k.keys {
+		if secureCompare(token, key.Token) {
+			matched = key
+		}
+	}
+	if matched != nil && record {
+		matched.lastUsed = time.Now()
+		matched.requests++
+	}
+	return matched
+}
+
+type accessKeyStatus struct {
+	Name        string     `json:"name"`
+	Fingerprint string     `json:"fingerprint"`
+	Scopes      []string   `json:"scopes,omitempty"`
+	LastUsed    *time.Time `json:"last_used"`
+	Requests    int64      `json:"requests"`
+}
+
+func (k *AccessKeys) Status() []accessKeyStatus {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	statuses := make([]accessKeyStatus, 0, len(k.keys))
+	for _, key := range k.keys {
+		status := accessKeyStatus{Name: key.Name, Fingerprint: tokenFingerprint(key.Token), Scopes: key.Scopes, Requests: key.requests}
+		if !key.lastUsed.IsZero() {
+			lastUsed := key.lastUsed.UTC()
+			status.LastUsed = &lastUsed
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+func tokenFingerprint(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return fmt.Sprintf("sha256:%x", sum[:4])
+}
+
+type logLimiter struct {
+	mu         sync.Mutex
+	interval   time.Duration
+	last       time.Time
+	suppressed int
+}
+
+func (l *logLimiter) Allow() (suppressed int, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now := time.Now(); now.Sub(l.last) >= l.interval {
+		suppressed, l.suppressed = l.suppressed, 0
+		l.last = now
+		return suppressed, true
+	}
+	l.suppressed++
+	return 0, false
+}
+
+var authFailureLog = &logLimiter{interval: 10 * time.Second}
+
+func VerifyAccessToken(keys *AccessKeys, basicCreds []BasicCredential) Middleware {
+	return verifyAccessToken(keys, basicCreds, true)
+}
+
+// AuthenticateAccessToken checks credentials like VerifyAccessToken, but
+// neither checks the path scopes of the key nor records its use. It is for
+// endpoints that translate requests for the api chain, whose own
+// VerifyAccessToken does both against the translated path.
+func AuthenticateAccessToken(keys *AccessKeys, basicCreds []BasicCredential) Middleware {
+	return verifyAccessToken(keys, basicCreds, false)
+}
+
+func verifyAccessToken(keys *AccessKeys, basicCreds []BasicCredential, scoped bool) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if keys.Len() == 0 && len(basicCreds) == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+				if key := keys.match(token, scoped); key != nil {
+					if scoped && !key.Allows(r.URL.Path) {
+						writeOpenAIError(w, http.StatusForbidden, "permission_error", fmt.Sprintf("access token %q may not access %s", key.Name, r.URL.Path))
+						return
+					}
+					requestInfoFrom(r.Context()).key = key.Name
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+			if user, password, ok := r.BasicAuth(); ok {
+				for _, cred := range basicCreds {
+					if secureCompare(user, cred.User) && secureCompare(password, cred.Password) {
+						requestInfoFrom(r.Context()).key = cred.User
+						next.ServeHTTP(w, r)
+						return
+					}
+				}
+			}
+
+			reason := "invalid"
+			if r.Header.Get("Authorization") == "" {
+				reason = "missing"
+			}
+			authFailures.Inc(reason)
+			if suppressed, ok := authFailureLog.Allow(); ok {
+				slog.Warn("authentication failed", "reason", reason, "remote_addr", r.RemoteAddr, "method", r.Method, "url", r.URL.String(), "suppressed", suppressed)
+			}
+
+			if len(basicCreds) > 0 {
+				w.Header().Set("WWW-Authenticate", `Basic realm="copilot-proxy", charset="UTF-8"`)
+			}
+			http.Error(w, "Invalid access token", http.StatusUnauthorized)
+		})
+	}
+}
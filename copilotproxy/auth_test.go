@@ -0,0 +1,37 @@
+package copilotproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestVerifyAccessTokenReplace(t *testing.T) {
+	keys, err := NewAccessKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := ApplyMiddlewares(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), TrackRequestInfo, VerifyAccessToken(keys, nil))
+	serve := func(token string) int {
+		r := httptest.NewRequest(http.MethodGet, "/models", nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	if code := serve(""); code != http.StatusOK {
+		t.Errorf("without access tokens: status = %d, want %d", code, http.StatusOK)
+	}
+	if err := keys.Replace(&AccessKey{Name: "alice", Token: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+	if code := serve(""); code != http.StatusUnauthorized {
+		t.Errorf("after replace, without token: status = %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code := serve("secret"); code != http.StatusOK {
+		t.Errorf("after replace, with token: status = %d, want %d", code, http.StatusOK)
+	}
+}
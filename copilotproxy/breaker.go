@@ -0,0 +1,170 @@
+package copilotproxy
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// CircuitBreaker stops sending requests upstream for a cooldown period
+// after a run of consecutive failures, then lets a single probe through
+// to decide whether to close again.
+type CircuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	window    time.Duration
+	cooldown  time.Duration
+
+	state        BreakerState
+	failures     int
+	firstFailure time.Time
+	openedAt     time.Time
+	probing      bool
+}
+
+func NewCircuitBreaker(threshold int, window, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{threshold: threshold, window: window, cooldown: cooldown}
+}
+
+func (b *CircuitBreaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BreakerOpen && time.Since(b.openedAt) >= b.cooldown {
+		return BreakerHalfOpen
+	}
+	return b.state
+}
+
+// allow reports whether a request may go upstream, and if not, how long
+// until the breaker half-opens. A request allowed while half-open is the
+// probe and must be followed by a call to record.
+func (b *CircuitBreaker) allow() (ok, probe bool, retryAfter time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerClosed:
+		return true, false, 0
+	case BreakerOpen:
+		if wait := b.cooldown - time.Since(b.openedAt); wait > 0 {
+			return false, false, wait
+		}
+		b.setState(BreakerHalfOpen)
+		slog.Info("circuit breaker half-open, probing upstream")
+	}
+	if b.probing {
+		return false, false, 0
+	}
+	b.probing = true
+	return true, true, 0
+}
+
+func (b *CircuitBreaker) setState(state BreakerState) {
+	b.state = state
+	breakerTransitions.Inc(state.String())
+}
+
+func (b *CircuitBreaker) record(probe, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if probe {
+		b.probing = false
+		if failed {
+			b.setState(BreakerOpen)
+			b.openedAt = time.Now()
+			slog.Warn("circuit breaker probe failed, reopening", "cooldown", b.cooldown)
+			return
+		}
+		b.setState(BreakerClosed)
+		b.failures = 0
+		slog.Info("circuit breaker closed")
+		return
+	}
+	if b.state != BreakerClosed {
+		return
+	}
+	if !failed {
+		b.failures = 0
+		return
+	}
+	now := time.Now()
+	if b.failures == 0 || now.Sub(b.firstFailure) > b.window {
+		b.failures = 0
+		b.firstFailure = now
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		b.setState(BreakerOpen)
+		b.openedAt = now
+		slog.Warn("circuit breaker opened", "failures", b.failures, "cooldown", b.cooldown)
+	}
+}
+
+func (b *CircuitBreaker) abandon(probe bool) {
+	if !probe {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+}
+
+func isUpstreamFailure(code int) bool {
+	return code >= 500 && code != http.StatusNotImplemented
+}
+
+func BreakCircuit(breaker *CircuitBreaker) Middleware {
+	return func(next http.Handler) http.Handler {
+		if breaker == nil {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ok, probe, retryAfter := breaker.allow()
+			if !ok {
+				if retryAfter > 0 {
+					w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+				}
+				writeOpenAIError(w, http.StatusServiceUnavailable, "upstream_error", "upstream is unavailable, circuit breaker is open")
+				return
+			}
+
+			r, info := withRequestInfo(r)
+			defer func() {
+				if !info.upstreamDone || errors.Is(r.Context().Err(), context.Canceled) {
+					// Responses written locally, such as a full queue, and
+					// clients going away say nothing about the upstream.
+					breaker.abandon(probe)
+					return
+				}
+				breaker.record(probe, info.upstreamCode == 0 || isUpstreamFailure(info.upstreamCode))
+			}()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
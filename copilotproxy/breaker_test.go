@@ -0,0 +1,92 @@
+package copilotproxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// upstreamHandler answers like the proxy with the outcome of rt.
+func upstreamHandler(rt http.RoundTripper) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rsp, err := recordUpstream{rt}.RoundTrip(r)
+		if err != nil {
+			writeOpenAIError(w, http.StatusBadGateway, "upstream_error", err.Error())
+			return
+		}
+		w.WriteHeader(rsp.StatusCode)
+	})
+}
+
+func TestBreakCircuitLocalResponses(t *testing.T) {
+	breaker := NewCircuitBreaker(1, time.Minute, time.Minute)
+	limiter := NewConcurrencyLimiter(1, 1, time.Millisecond)
+	if err := limiter.Acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var upstreamCalls int
+	ok := upstreamHandler(roundTripperFunc(func(*http.Request) (*http.Response, error) {
+		upstreamCalls++
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+	}))
+
+	queued := BreakCircuit(breaker)(LimitConcurrency(limiter)(ok))
+	w := httptest.NewRecorder()
+	queued.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/chat/completions", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("queued status = %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+	if upstreamCalls != 0 {
+		t.Fatalf("upstream called %d times", upstreamCalls)
+	}
+	if state := breaker.State(); state != BreakerClosed {
+		t.Fatalf("breaker %s after a local 503, want closed", state)
+	}
+
+	local := BreakCircuit(breaker)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Service not ready", http.StatusServiceUnavailable)
+	}))
+	local.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/chat/completions", nil))
+	if state := breaker.State(); state != BreakerClosed {
+		t.Fatalf("breaker %s after a local 503, want closed", state)
+	}
+}
+
+func TestBreakCircuitUpstreamFailures(t *testing.T) {
+	tests := []struct {
+		name string
+		rt   roundTripperFunc
+		want BreakerState
+	}{
+		{"ok", func(*http.Request) (*http.Response, error) {
+			return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+		}, BreakerClosed},
+		{"client error", func(*http.Request) (*http.Response, error) {
+			return &http.Response{StatusCode: http.StatusBadRequest, Body: http.NoBody}, nil
+		}, BreakerClosed},
+		{"server error", func(*http.Request) (*http.Response, error) {
+			return &http.Response{StatusCode: http.StatusBadGateway, Body: http.NoBody}, nil
+		}, BreakerOpen},
+		{"transport error", func(*http.Request) (*http.Response, error) {
+			return nil, errors.New("connection refused")
+		}, BreakerOpen},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			breaker := NewCircuitBreaker(1, time.Minute, time.Minute)
+			BreakCircuit(breaker)(upstreamHandler(tt.rt)).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/chat/completions", nil))
+			if state := breaker.State(); state != tt.want {
+				t.Errorf("breaker %s, want %s", state, tt.want)
+			}
+		})
+	}
+}
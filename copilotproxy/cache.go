@@ -0,0 +1,167 @@
+package copilotproxy
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+type cachedResponse struct {
+	key       [sha256.Size]byte
+	header    http.Header
+	body      []byte
+	expiresAt time.Time
+}
+
+type ResponseCache struct {
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]*list.Element
+	lru     *list.List
+	max     int
+	ttl     time.Duration
+}
+
+func NewResponseCache(max int, ttl time.Duration) *ResponseCache {
+	return &ResponseCache{
+		entries: make(map[[sha256.Size]byte]*list.Element),
+		lru:     list.New(),
+		max:     max,
+		ttl:     ttl,
+	}
+}
+
+func (c *ResponseCache) Get(key [sha256.Size]byte) (*cachedResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*cachedResponse)
+	if time.Now().After(entry.expiresAt) {
+		c.lru.Remove(elem)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return entry, true
+}
+
+func (c *ResponseCache) Put(entry *cachedResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry.expiresAt = time.Now().Add(c.ttl)
+	if elem, ok := c.entries[entry.key]; ok {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.max {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedResponse).key)
+	}
+}
+
+type responseRecorder struct {
+	http.ResponseWriter
+
+	code   int
+	header http.Header
+	body   bytes.Buffer
+	max    int
+	over   bool
+}
+
+func (w *responseRecorder) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+		w.header = w.ResponseWriter.Header().Clone()
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *responseRecorder) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.over {
+		if w.body.Len()+len(b) > w.max {
+			w.over = true
+			w.body.Reset()
+		} else {
+			w.body.Write(b)
+		}
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *responseRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+const maxCachedResponseBytes = 8 << 20
+
+func CacheEmbeddings(cache *ResponseCache) Middleware {
+	return func(next http.Handler) http.Handler {
+		if cache == nil {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost || !strings.HasSuffix(strings.TrimSuffix(r.URL.Path, "/"), "/embeddings") {
+				next.ServeHTTP(w, r)
+				return
+			}
+			body, err := readBody(r)
+			if err != nil {
+				writeOpenAIError(w, bodyReadStatus(err), "invalid_request_error", "failed to read request body")
+				return
+			}
+			if isStreamRequest(body) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			h := sha256.New()
+			h.Write([]byte(path.Clean(normalizePath(r.URL.Path))))
+			h.Write([]byte{0})
+			// The upstream and integration a client selects may answer
+			// differently, so they are part of the key too.
+			for _, name := range []string{"Accept-Encoding", "X-Upstream", "X-Copilot-Integration"} {
+				h.Write([]byte(r.Header.Get(name)))
+				h.Write([]byte{0})
+			}
+			h.Write(body)
+			var key [sha256.Size]byte
+			h.Sum(key[:0])
+
+			if entry, ok := cache.Get(key); ok {
+				for k, v := range entry.header {
+					w.Header()[k] = v
+				}
+				w.Header().Set("X-Cache", "HIT")
+				w.WriteHeader(http.StatusOK)
+				_, _ = w.Write(entry.body)
+				return
+			}
+
+			w.Header().Set("X-Cache", "MISS")
+			rec := &responseRecorder{ResponseWriter: w, max: maxCachedResponseBytes}
+			next.ServeHTTP(rec, r)
+
+			if rec.code == http.StatusOK && !rec.over && !isEventStream(rec.header) {
+				rec.header.Del("X-Cache")
+				rec.header.Del("Date")
+				cache.Put(&cachedResponse{key: key, header: rec.header, body: bytes.Clone(rec.body.Bytes())})
+			}
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package copilotproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCacheEmbeddingsKey(t *testing.T) {
+	var calls int
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"object":"list","data":[]}`))
+	})
+	handler := CacheEmbeddings(NewResponseCache(16, time.Minute))(upstream)
+
+	tests := []struct {
+		name   string
+		header http.Header
+		body   string
+		cached bool
+	}{
+		{"first", nil, `{"input":"hi"}`, false},
+		{"repeat", nil, `{"input":"hi"}`, true},
+		{"other body", nil, `{"input":"ho"}`, false},
+		{"other upstream", http.Header{"X-Upstream": {"https://copilot.example.com"}}, `{"input":"hi"}`, false},
+		{"other upstream repeat", http.Header{"X-Upstream": {"https://copilot.example.com"}}, `{"input":"hi"}`, true},
+		{"other integration", http.Header{"X-Copilot-Integration": {"copilot-chat"}}, `{"input":"hi"}`, false},
+		{"other encoding", http.Header{"Accept-Encoding": {"gzip"}}, `{"input":"hi"}`, false},
+	}
+	for _, tt := range tests {
+		before := calls
+		r := httptest.NewRequest(http.MethodPost, "/embeddings", strings.NewReader(tt.body))
+		for name, values := range tt.header {
+			r.Header[name] = values
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if cached := calls == before; cached != tt.cached {
+			t.Errorf("%s: cached = %v, want %v", tt.name, cached, tt.cached)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package copilotproxy
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+)
+
+var secretPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)("(?:api_key|access_token|token|authorization|password|secret)"\s*:\s*")[^"]*(")`),
+	regexp.MustCompile(`(?i)(bearer\s+)[A-Za-z0-9._~+/=-]+()`),
+	regexp.MustCompile(`()\bgh[opsur]_[A-Za-z0-9]{16,}()`),
+}
+
+func redactSecrets(s string) string {
+	for _, pattern := range secretPatterns {
+		s = pattern.ReplaceAllString(s, "${1}[REDACTED]${2}")
+	}
+	return s
+}
+
+type bodyCapture struct {
+	buf       bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (c *bodyCapture) capture(p []byte) {
+	if room := c.max - c.buf.Len(); room < len(p) {
+		c.truncated = true
+		p = p[:max(room, 0)]
+	}
+	c.buf.Write(p)
+}
+
+func (c *bodyCapture) String() string {
+	body := redactSecrets(c.buf.String())
+	if c.truncated {
+		body += "...(truncated)"
+	}
+	return body
+}
+
+// decoded is like String but undoes contentEncoding first, leaving the
+// bytes as captured if they cannot be decoded.
+func (c *bodyCapture) decoded(contentEncoding string) string {
+	body, err := decodeBody(contentEncoding, c.buf.Bytes(), int64(c.max))
+	if err != nil && len(body) == 0 {
+		return c.String()
+	}
+	s := redactSecrets(string(body))
+	if c.truncated || err != nil {
+		s += "...(truncated)"
+	}
+	return s
+}
+
+type capturingReader struct {
+	io.ReadCloser
+
+	capture *bodyCapture
+}
+
+func (r *capturingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.capture.capture(p[:n])
+	return n, err
+}
+
+type capturingWriter struct {
+	http.ResponseWriter
+
+	capture *bodyCapture
+}
+
+func (w *capturingWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.capture.capture(p[:n])
+	return n, err
+}
+
+func (w *capturingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func DebugBodies(enabled bool, maxBytes int) Middleware {
+	return func(next http.Handler) http.Handler {
+		if !enabled {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			reqBody := &bodyCapture{max: maxBytes}
+			if r.Body != nil && r.Body != http.NoBody {
+				r.Body = &capturingReader{ReadCloser: r.Body, capture: reqBody}
+			}
+			cw := &capturingWriter{ResponseWriter: w, capture: &bodyCapture{max: maxBytes}}
+
+			defer func() {
+				slog.Debug("proxied bodies", "method", r.Method, "url", r.URL.String(), "request_body", reqBody.String(), "response_body", cw.capture.decoded(cw.Header().Get("Content-Encoding")))
+			}()
+
+			next.ServeHTTP(cw, r)
+		})
+	}
+}
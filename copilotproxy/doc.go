@@ -0,0 +1,18 @@
+// Package copilotproxy exchanges a GitHub Copilot OAuth token for
+// short-lived Copilot API tokens and proxies OpenAI-compatible requests to
+// the Copilot API with them.
+//
+// A minimal embedding looks like:
+//
+//	ts := copilotproxy.NewTokenSource(oauthToken)
+//	go ts.Start(ctx)
+//
+//	upstream, _ := url.Parse(copilotproxy.APIEndpoint)
+//	mux.Handle("/copilot/", copilotproxy.ApplyMiddlewares(ts.NewProxy(upstream),
+//		copilotproxy.StripPrefix("/copilot"),
+//	))
+//
+// The exported fields of TokenSource tune refreshing and the headers sent
+// upstream; set them before calling Start. The Middleware helpers are the
+// ones the copilot-proxy command builds its request chain from.
+package copilotproxy
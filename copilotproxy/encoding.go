@@ -0,0 +1,68 @@
+package copilotproxy
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// decodeBody undoes the Content-Encoding of a response body so it can be
+// inspected. It works on a copy: the encoded bytes are what gets forwarded,
+// so clients that asked for compression still receive it. At most max
+// decoded bytes are returned. A truncated body yields what could be decoded
+// together with the error.
+func decodeBody(contentEncoding string, body []byte, max int64) ([]byte, error) {
+	var codings []string
+	for coding := range strings.SplitSeq(contentEncoding, ",") {
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding != "" && coding != "identity" {
+			codings = append(codings, coding)
+		}
+	}
+	if len(codings) == 0 {
+		return body, nil
+	}
+
+	var r io.Reader = bytes.NewReader(body)
+	for i := len(codings) - 1; i >= 0; i-- {
+		var err error
+		if r, err = decodingReader(codings[i], r); err != nil {
+			return nil, err
+		}
+	}
+	decoded, err := io.ReadAll(io.LimitReader(r, max))
+	if err != nil {
+		return decoded, fmt.Errorf("failed to decode %s body: %w", contentEncoding, err)
+	}
+	return decoded, nil
+}
+
+func decodingReader(coding string, r io.Reader) (io.Reader, error) {
+	switch coding {
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode gzip body: %w", err)
+		}
+		return zr, nil
+	case "deflate":
+		// "deflate" is meant to be zlib-wrapped, but some servers send raw
+		// DEFLATE data.
+		br := bufio.NewReader(r)
+		if header, err := br.Peek(2); err == nil && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 && header[0]&0x0f == 8 {
+			zr, err := zlib.NewReader(br)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode deflate body: %w", err)
+			}
+			return zr, nil
+		}
+		return flate.NewReader(br), nil
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", coding)
+	}
+}
@@ -0,0 +1,187 @@
+package copilotproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var essentialHeaders = map[string]bool{
+	"Content-Type":      true,
+	"Content-Length":    true,
+	"Content-Encoding":  true,
+	"Transfer-Encoding": true,
+}
+
+func RewriteResponseHeaders(strip []string, add http.Header) func(*http.Response) error {
+	return func(rsp *http.Response) error {
+		for _, key := range strip {
+			rsp.Header.Del(key)
+		}
+		for key, values := range add {
+			if essentialHeaders[key] && rsp.Header.Get(key) != "" {
+				continue
+			}
+			rsp.Header[key] = values
+		}
+		return nil
+	}
+}
+
+// ParseStatusRemaps parses from=to pairs of HTTP status codes.
+func ParseStatusRemaps(values []string) (map[int]int, error) {
+	remaps := make(map[int]int, len(values))
+	for _, value := range values {
+		fromStr, toStr, ok := strings.Cut(value, "=")
+		from, fromErr := strconv.Atoi(strings.TrimSpace(fromStr))
+		to, toErr := strconv.Atoi(strings.TrimSpace(toStr))
+		if !ok || fromErr != nil || toErr != nil || from < 100 || from > 599 || to < 100 || to > 599 {
+			return nil, fmt.Errorf("invalid status remap %q, expected from=to status codes", value)
+		}
+		if from == to {
+			return nil, fmt.Errorf("invalid status remap %q, status is mapped to itself", value)
+		}
+		if _, ok := remaps[from]; ok {
+			return nil, fmt.Errorf("duplicate status remap for %d", from)
+		}
+		remaps[from] = to
+	}
+	return remaps, nil
+}
+
+// RemapStatus rewrites upstream status codes that clients should see as a
+// different one. The body is passed on as is.
+func RemapStatus(remaps map[int]int) func(*http.Response) error {
+	return func(rsp *http.Response) error {
+		if to, ok := remaps[rsp.StatusCode]; ok {
+			rsp.StatusCode = to
+			rsp.Status = fmt.Sprintf("%d %s", to, http.StatusText(to))
+		}
+		return nil
+	}
+}
+
+// entitlementCodes maps the error codes of Copilot API error bodies,
+// {"error": {"code": ...}}, to the entitlement problem they report.
+var entitlementCodes = map[string]string{
+	"not_entitled":           "not_entitled",
+	"no_access":              "not_entitled",
+	"copilot_not_enabled":    "not_entitled",
+	"subscription_required":  "not_entitled",
+	"quota_exceeded":         "quota_exceeded",
+	"insufficient_quota":     "quota_exceeded",
+	"usage_limit_exceeded":   "quota_exceeded",
+	"rate_limited":           "rate_limited",
+	"rate_limit_exceeded":    "rate_limited",
+	"user_rate_limited":      "rate_limited",
+	"integration_rate_limit": "rate_limited",
+}
+
+func entitlementReason(status int, body []byte) string {
+	var payload struct {
+		Code  string `json:"code"`
+		Error struct {
+			Code string `json:"code"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(body, &payload) == nil {
+		code := payload.Error.Code
+		if code == "" {
+			code = payload.Code
+		}
+		if reason, ok := entitlementCodes[strings.ToLower(code)]; ok {
+			return reason
+		}
+	}
+	switch status {
+	case http.StatusPaymentRequired:
+		return "quota_exceeded"
+	case http.StatusTooManyRequests:
+		return "rate_limited"
+	}
+	return ""
+}
+
+// entitlementRecoverAfter is how long a degraded EntitlementMonitor stays
+// degraded without a successful response or token refresh. /ready fails
+// meanwhile, so no traffic may come along to clear it.
+const entitlementRecoverAfter = 5 * time.Minute
+
+type entitlementState struct {
+	reason string
+	since  time.Time
+}
+
+type EntitlementMonitor struct {
+	degrade bool
+	state   atomic.Pointer[entitlementState]
+}
+
+func NewEntitlementMonitor(degrade bool) *EntitlementMonitor {
+	return &EntitlementMonitor{degrade: degrade}
+}
+
+func (m *EntitlementMonitor) Degraded() string {
+	if !m.degrade {
+		return ""
+	}
+	state := m.state.Load()
+	if state == nil {
+		return ""
+	}
+	if time.Since(state.since) >= entitlementRecoverAfter {
+		if m.state.CompareAndSwap(state, nil) {
+			slog.Info("copilot entitlement degradation expired", "reason", state.reason, "after", entitlementRecoverAfter)
+		}
+		return ""
+	}
+	return state.reason
+}
+
+// Recover clears a recorded entitlement error, e.g. once the token endpoint
+// has issued a new token, which it only does for entitled accounts.
+func (m *EntitlementMonitor) Recover() {
+	if m.state.Swap(nil) != nil {
+		slog.Info("copilot entitlement recovered")
+	}
+}
+
+func (m *EntitlementMonitor) Hook(rsp *http.Response) error {
+	switch rsp.StatusCode {
+	case http.StatusUnauthorized, http.StatusPaymentRequired, http.StatusForbidden, http.StatusTooManyRequests:
+	default:
+		if rsp.StatusCode < 300 {
+			m.Recover()
+		}
+		return nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(rsp.Body, 64<<10))
+	rsp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), rsp.Body), rsp.Body}
+	if err != nil {
+		return nil
+	}
+	if body, err = decodeBody(rsp.Header.Get("Content-Encoding"), body, 64<<10); err != nil && len(body) == 0 {
+		return nil
+	}
+
+	reason := entitlementReason(rsp.StatusCode, body)
+	if reason == "" {
+		return nil
+	}
+	slog.Warn("copilot entitlement error", "reason", reason, "status", rsp.StatusCode, "url", rsp.Request.URL.String(), "body", redactSecrets(string(body)))
+	if reason != "rate_limited" {
+		m.state.Store(&entitlementState{reason: reason, since: time.Now()})
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package copilotproxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEntitlementReason(t *testing.T) {
+	tests := []struct {
+		status int
+		body   string
+		want   string
+	}{
+		{http.StatusForbidden, `{"error":{"message":"not entitled","code":"not_entitled"}}`, "not_entitled"},
+		{http.StatusForbidden, `{"error":{"code":"no_access"}}`, "not_entitled"},
+		{http.StatusForbidden, `{"code":"quota_exceeded"}`, "quota_exceeded"},
+		{http.StatusTooManyRequests, `{"error":{"code":"rate_limited"}}`, "rate_limited"},
+		{http.StatusTooManyRequests, `slow down`, "rate_limited"},
+		{http.StatusPaymentRequired, `{}`, "quota_exceeded"},
+		{http.StatusForbidden, `{"error":{"message":"your subscription quota does not cover this file"}}`, ""},
+		{http.StatusForbidden, `forbidden: exceeded your permissions`, ""},
+		{http.StatusUnauthorized, `{"error":{"code":"invalid_token"}}`, ""},
+	}
+	for _, tt := range tests {
+		if got := entitlementReason(tt.status, []byte(tt.body)); got != tt.want {
+			t.Errorf("entitlementReason(%d, %s) = %q, want %q", tt.status, tt.body, got, tt.want)
+		}
+	}
+}
+
+func TestEntitlementMonitorRecovers(t *testing.T) {
+	m := NewEntitlementMonitor(true)
+	rejected := func() *http.Response {
+		return &http.Response{
+			StatusCode: http.StatusForbidden,
+			Header:     http.Header{"Content-Type": {"application/json"}},
+			Body:       io.NopCloser(strings.NewReader(`{"error":{"code":"not_entitled"}}`)),
+			Request:    httptest.NewRequest(http.MethodPost, "/chat/completions", nil),
+		}
+	}
+
+	_ = m.Hook(rejected())
+	if got := m.Degraded(); got != "not_entitled" {
+		t.Fatalf("Degraded() = %q after a rejection, want not_entitled", got)
+	}
+	m.Recover()
+	if got := m.Degraded(); got != "" {
+		t.Fatalf("Degraded() = %q after Recover, want none", got)
+	}
+
+	_ = m.Hook(rejected())
+	m.state.Load().since = time.Now().Add(-entitlementRecoverAfter)
+	if got := m.Degraded(); got != "" {
+		t.Fatalf("Degraded() = %q after %s, want none", got, entitlementRecoverAfter)
+	}
+}
@@ -0,0 +1,417 @@
+package copilotproxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+type metricFamily interface {
+	name() string
+	writeText(w io.Writer, openMetrics bool)
+	snapshot() metricSnapshot
+}
+
+type metricSnapshot struct {
+	Type   string           `json:"type"`
+	Help   string           `json:"help"`
+	Series []seriesSnapshot `json:"series"`
+}
+
+type seriesSnapshot struct {
+	Labels  map[string]string `json:"labels,omitempty"`
+	Value   *float64          `json:"value,omitempty"`
+	Count   *uint64           `json:"count,omitempty"`
+	Sum     *float64          `json:"sum,omitempty"`
+	Buckets map[string]uint64 `json:"buckets,omitempty"`
+}
+
+type MetricsRegistry struct {
+	mu       sync.RWMutex
+	families []metricFamily
+}
+
+func (reg *MetricsRegistry) register(family metricFamily) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	reg.families = append(reg.families, family)
+}
+
+func (reg *MetricsRegistry) unregister(family metricFamily) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	families := make([]metricFamily, 0, len(reg.families))
+	for _, f := range reg.families {
+		if f != family {
+			families = append(families, f)
+		}
+	}
+	reg.families = families
+}
+
+func (reg *MetricsRegistry) list() []metricFamily {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+
+	return reg.families
+}
+
+func (reg *MetricsRegistry) WriteText(w io.Writer, openMetrics bool) {
+	for _, family := range reg.list() {
+		family.writeText(w, openMetrics)
+	}
+	if openMetrics {
+		_, _ = io.WriteString(w, "# EOF\n")
+	}
+}
+
+func (reg *MetricsRegistry) Snapshot() map[string]metricSnapshot {
+	snapshot := make(map[string]metricSnapshot)
+	for _, family := range reg.list() {
+		snapshot[family.name()] = family.snapshot()
+	}
+	return snapshot
+}
+
+func (reg *MetricsRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	accept := r.Header.Get("Accept")
+	switch {
+	case strings.HasSuffix(r.URL.Path, ".json") || strings.Contains(accept, "application/json"):
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(reg.Snapshot())
+	case strings.Contains(accept, "application/openmetrics-text"):
+		w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+		reg.WriteText(w, true)
+	default:
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		reg.WriteText(w, false)
+	}
+}
+
+// Metrics holds every metric created by this package.
+var Metrics = &MetricsRegistry{}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string, extra ...string) string {
+	if len(names) == 0 && len(extra) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name + `="` + labelEscaper.Replace(values[i]) + `"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		if b.Len() > 1 {
+			b.WriteByte(',')
+		}
+		b.WriteString(extra[i] + `="` + labelEscaper.Replace(extra[i+1]) + `"`)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func labelMap(names, values []string) map[string]string {
+	if len(names) == 0 {
+		return nil
+	}
+	m := make(map[string]string, len(names))
+	for i, name := range names {
+		m[name] = values[i]
+	}
+	return m
+}
+
+func writeHeader(w io.Writer, name, typ, help string, openMetrics bool) {
+	if openMetrics && typ == "counter" {
+		name = strings.TrimSuffix(name, "_total")
+	}
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+type seriesKey string
+
+func makeSeriesKey(values []string) seriesKey {
+	return seriesKey(strings.Join(values, "\xff"))
+}
+
+type series[T any] struct {
+	values []string
+	data   *T
+}
+
+type metricVec[T any] struct {
+	mu     sync.RWMutex
+	series map[seriesKey]*series[T]
+	labels []string
+	init   func() *T
+}
+
+func (v *metricVec[T]) with(values ...string) *T {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("expected %d label values, got %d", len(v.labels), len(values)))
+	}
+	key := makeSeriesKey(values)
+
+	v.mu.RLock()
+	s, ok := v.series[key]
+	v.mu.RUnlock()
+	if ok {
+		return s.data
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if s, ok := v.series[key]; ok {
+		return s.data
+	}
+	s = &series[T]{values: values, data: v.init()}
+	v.series[key] = s
+	return s.data
+}
+
+func (v *metricVec[T]) sorted() []*series[T] {
+	v.mu.RLock()
+	list := make([]*series[T], 0, len(v.series))
+	for _, s := range v.series {
+		list = append(list, s)
+	}
+	v.mu.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return makeSeriesKey(list[i].values) < makeSeriesKey(list[j].values)
+	})
+	return list
+}
+
+type atomicFloat struct {
+	bits atomic.Uint64
+}
+
+func (f *atomicFloat) Add(delta float64) {
+	for {
+		old := f.bits.Load()
+		if f.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+delta)) {
+			return
+		}
+	}
+}
+
+func (f *atomicFloat) Load() float64 {
+	return math.Float64frombits(f.bits.Load())
+}
+
+type CounterVec struct {
+	metricVec[atomicFloat]
+
+	metricName string
+	help       string
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		metricVec: metricVec[atomicFloat]{
+			series: make(map[seriesKey]*series[atomicFloat]),
+			labels: labels,
+			init:   func() *atomicFloat { return new(atomicFloat) },
+		},
+		metricName: name,
+		help:       help,
+	}
+	Metrics.register(c)
+	return c
+}
+
+func (c *CounterVec) Inc(values ...string) {
+	c.with(values...).Add(1)
+}
+
+func (c *CounterVec) Add(delta float64, values ...string) {
+	c.with(values...).Add(delta)
+}
+
+func (c *CounterVec) name() string {
+	return c.metricName
+}
+
+func (c *CounterVec) writeText(w io.Writer, openMetrics bool) {
+	writeHeader(w, c.metricName, "counter", c.help, openMetrics)
+	for _, s := range c.sorted() {
+		fmt.Fprintf(w, "%s%s %s\n", c.metricName, formatLabels(c.labels, s.values), formatFloat(s.data.Load()))
+	}
+}
+
+func (c *CounterVec) snapshot() metricSnapshot {
+	snapshot := metricSnapshot{Type: "counter", Help: c.help, Series: []seriesSnapshot{}}
+	for _, s := range c.sorted() {
+		value := s.data.Load()
+		snapshot.Series = append(snapshot.Series, seriesSnapshot{Labels: labelMap(c.labels, s.values), Value: &value})
+	}
+	return snapshot
+}
+
+type GaugeFunc struct {
+	metricName string
+	help       string
+	fn         func() float64
+}
+
+func NewGaugeFunc(name, help string, fn func() float64) *GaugeFunc {
+	g := &GaugeFunc{metricName: name, help: help, fn: fn}
+	Metrics.register(g)
+	return g
+}
+
+// Unregister removes g from Metrics, for gauges whose getter reads state
+// that lives shorter than the process.
+func (g *GaugeFunc) Unregister() {
+	Metrics.unregister(g)
+}
+
+func (g *GaugeFunc) name() string {
+	return g.metricName
+}
+
+func (g *GaugeFunc) writeText(w io.Writer, openMetrics bool) {
+	writeHeader(w, g.metricName, "gauge", g.help, openMetrics)
+	fmt.Fprintf(w, "%s %s\n", g.metricName, formatFloat(g.fn()))
+}
+
+func (g *GaugeFunc) snapshot() metricSnapshot {
+	value := g.fn()
+	return metricSnapshot{Type: "gauge", Help: g.help, Series: []seriesSnapshot{{Value: &value}}}
+}
+
+type histogram struct {
+	mu     sync.Mutex
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+type HistogramVec struct {
+	metricVec[histogram]
+
+	metricName string
+	help       string
+	buckets    []float64
+}
+
+var defaultBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{
+		metricVec: metricVec[histogram]{
+			series: make(map[seriesKey]*series[histogram]),
+			labels: labels,
+			init:   func() *histogram { return &histogram{counts: make([]uint64, len(buckets))} },
+		},
+		metricName: name,
+		help:       help,
+		buckets:    buckets,
+	}
+	Metrics.register(h)
+	return h
+}
+
+func (h *HistogramVec) Observe(value float64, values ...string) {
+	hist := h.with(values...)
+	i := sort.SearchFloat64s(h.buckets, value)
+
+	hist.mu.Lock()
+	defer hist.mu.Unlock()
+	if i < len(hist.counts) {
+		hist.counts[i]++
+	}
+	hist.count++
+	hist.sum += value
+}
+
+func (h *HistogramVec) name() string {
+	return h.metricName
+}
+
+func (h *HistogramVec) read(hist *histogram) (cumulative []uint64, count uint64, sum float64) {
+	hist.mu.Lock()
+	defer hist.mu.Unlock()
+
+	cumulative = make([]uint64, len(hist.counts))
+	var total uint64
+	for i, c := range hist.counts {
+		total += c
+		cumulative[i] = total
+	}
+	return cumulative, hist.count, hist.sum
+}
+
+func (h *HistogramVec) writeText(w io.Writer, openMetrics bool) {
+	writeHeader(w, h.metricName, "histogram", h.help, openMetrics)
+	for _, s := range h.sorted() {
+		cumulative, count, sum := h.read(s.data)
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.metricName, formatLabels(h.labels, s.values, "le", formatFloat(bound)), cumulative[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.metricName, formatLabels(h.labels, s.values, "le", "+Inf"), count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.metricName, formatLabels(h.labels, s.values), formatFloat(sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.metricName, formatLabels(h.labels, s.values), count)
+	}
+}
+
+func (h *HistogramVec) snapshot() metricSnapshot {
+	snapshot := metricSnapshot{Type: "histogram", Help: h.help, Series: []seriesSnapshot{}}
+	for _, s := range h.sorted() {
+		cumulative, count, sum := h.read(s.data)
+		buckets := make(map[string]uint64, len(h.buckets)+1)
+		for i, bound := range h.buckets {
+			buckets[formatFloat(bound)] = cumulative[i]
+		}
+		buckets["+Inf"] = count
+		snapshot.Series = append(snapshot.Series, seriesSnapshot{Labels: labelMap(h.labels, s.values), Count: &count, Sum: &sum, Buckets: buckets})
+	}
+	return snapshot
+}
+
+// keyLabel identifies an access token in metric labels by a hash of its
+// name, as /metrics is served without auth.
+func keyLabel(name string) string {
+	if name == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(name))
+	return hex.EncodeToString(sum[:6])
+}
+
+var (
+	requestsTotal        = NewCounterVec("copilot_proxy_requests_total", "Total number of proxied Copilot API requests.", "method", "status", "stream", "model")
+	requestDuration      = NewHistogramVec("copilot_proxy_request_duration_seconds", "Duration of proxied Copilot API requests.", defaultBuckets, "method", "stream")
+	tokenRefreshes       = NewCounterVec("copilot_proxy_token_refreshes_total", "Total number of Copilot token refreshes.", "outcome")
+	authFailures         = NewCounterVec("copilot_proxy_auth_failures_total", "Total number of requests rejected for missing or invalid credentials.", "reason")
+	tokenRefreshDuration = NewHistogramVec("copilot_proxy_token_refresh_duration_seconds", "Duration of Copilot token refresh requests.", defaultBuckets, "outcome")
+	inFlight             atomic.Int64
+	inFlightRequests     = NewGaugeFunc("copilot_proxy_in_flight_requests", "Number of proxied Copilot API requests currently being served.", func() float64 { return float64(inFlight.Load()) })
+	clientDisconnects    = NewCounterVec("copilot_proxy_client_disconnect_total", "Total number of proxied requests aborted by the client before the response was complete.", "stream")
+	keyRateLimited       = NewCounterVec("copilot_proxy_key_rate_limited_total", "Total number of requests rejected by the per access token rate limit.", "key", "limit")
+	quotaExceeded        = NewCounterVec("copilot_proxy_quota_exceeded_total", "Total number of requests rejected because the access token used up its token quota.", "key", "period")
+	breakerTransitions   = NewCounterVec("copilot_proxy_circuit_breaker_transitions_total", "Total number of upstream circuit breaker state changes, by the state entered.", "state")
+	upstreamRetries      = NewCounterVec("copilot_proxy_upstream_retries_total", "Total number of upstream requests retried after a 429, a transient 5xx or a transport error.", "reason")
+	usageRecordsDropped  = NewCounterVec("copilot_proxy_usage_records_dropped_total", "Total number of usage records that could not be written to the usage database.")
+)
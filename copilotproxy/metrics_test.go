@@ -0,0 +1,32 @@
+package copilotproxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestKeyMetricsHideNames(t *testing.T) {
+	limiter := NewKeyRateLimiter(1, 0)
+	handler := LimitKeys(limiter)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for range 2 {
+		r := httptest.NewRequest(http.MethodPost, "/chat/completions", nil)
+		r, info := withRequestInfo(r)
+		info.key = "alice-secret-project"
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	var out bytes.Buffer
+	keyRateLimited.writeText(&out, false)
+	if strings.Contains(out.String(), "alice-secret-project") {
+		t.Errorf("metrics expose the access token name:\n%s", out.String())
+	}
+	if want := `key="` + keyLabel("alice-secret-project") + `"`; !strings.Contains(out.String(), want) {
+		t.Errorf("metrics lack %s:\n%s", want, out.String())
+	}
+	if got := keyLabel("alice"); got != "2bd806c97f0e" {
+		t.Errorf("keyLabel(alice) = %q, want the first 12 hex digits of its SHA-256", got)
+	}
+}
@@ -0,0 +1,525 @@
+package copilotproxy
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Middleware wraps an http.Handler.
+type Middleware func(http.Handler) http.Handler
+
+// ApplyMiddlewares wraps handler so that the first middleware runs first.
+func ApplyMiddlewares(handler http.Handler, middlewares ...Middleware) http.Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+type ChainEntry struct {
+	Name       string
+	Middleware Middleware
+	Required   bool
+}
+
+func BuildChain(entries []ChainEntry, disabled []string) ([]Middleware, []string, error) {
+	skip := make(map[string]bool, len(disabled))
+	for _, name := range disabled {
+		i := slices.IndexFunc(entries, func(e ChainEntry) bool { return e.Name == name })
+		if i < 0 {
+			return nil, nil, fmt.Errorf("unknown middleware %q", name)
+		}
+		if entries[i].Required {
+			return nil, nil, fmt.Errorf("middleware %q cannot be disabled", name)
+		}
+		skip[name] = true
+	}
+
+	middlewares := make([]Middleware, 0, len(entries))
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if skip[e.Name] {
+			continue
+		}
+		middlewares = append(middlewares, e.Middleware)
+		names = append(names, e.Name)
+	}
+	return middlewares, names, nil
+}
+
+func RecoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if err := recover(); err != nil {
+				if err == http.ErrAbortHandler {
+					panic(err)
+				}
+				slog.Error("panic serving request", "error", err, "method", r.Method, "url", r.URL.String(), "request_id", r.Header.Get("X-Request-Id"))
+				writeOpenAIError(w, http.StatusInternalServerError, "server_error", "internal server error")
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-Id")
+		if id == "" || len(id) > 128 {
+			id = fmt.Sprintf("%016x", rand.Uint64())
+			r.Header.Set("X-Request-Id", id)
+		}
+		w.Header().Set("X-Request-Id", id)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func LimitBody(max int64) Middleware {
+	return func(next http.Handler) http.Handler {
+		if max <= 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength > max {
+				writeOpenAIError(w, http.StatusRequestEntityTooLarge, "invalid_request_error", "request body too large")
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, max)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func isUpgradeRequest(r *http.Request) bool {
+	for _, value := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return r.Header.Get("Upgrade") != ""
+}
+
+func RestrictMethods(methods []string) Middleware {
+	return func(next http.Handler) http.Handler {
+		if len(methods) == 0 {
+			return next
+		}
+		allowed := make([]string, 0, len(methods))
+		for _, method := range methods {
+			allowed = append(allowed, strings.ToUpper(strings.TrimSpace(method)))
+		}
+		allow := strings.Join(allowed, ", ")
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !slices.Contains(allowed, r.Method) {
+				w.Header().Set("Allow", allow)
+				writeOpenAIError(w, http.StatusMethodNotAllowed, "invalid_request_error", fmt.Sprintf("method %s is not allowed", r.Method))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func RejectUpgrades(allow bool) Middleware {
+	return func(next http.Handler) http.Handler {
+		if allow {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if isUpgradeRequest(r) {
+				writeOpenAIError(w, http.StatusNotImplemented, "invalid_request_error", fmt.Sprintf("protocol upgrade to %q is not supported, the Copilot API is plain HTTP", r.Header.Get("Upgrade")))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// ValidateJSON rejects POSTs to the completion and embeddings endpoints whose
+// Content-Type is not application/json or whose body is not a JSON object.
+func ValidateJSON(enabled bool) Middleware {
+	return func(next http.Handler) http.Handler {
+		if !enabled {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			path := strings.TrimSuffix(r.URL.Path, "/")
+			if r.Method != http.MethodPost || !(isCompletionPath(path) || strings.HasSuffix(path, "/embeddings")) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+				writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "Content-Type must be application/json")
+				return
+			}
+			var buf bytes.Buffer
+			body := r.Body
+			if err := checkJSONObject(io.TeeReader(body, &buf)); err != nil {
+				if code := bodyReadStatus(err); code == http.StatusRequestEntityTooLarge {
+					writeOpenAIError(w, code, "invalid_request_error", "request body too large")
+					return
+				}
+				writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "request body is not valid JSON: "+err.Error())
+				return
+			}
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(&buf, body), body}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// checkJSONObject walks the tokens of a single JSON object without
+// decoding it into values.
+func checkJSONObject(r io.Reader) error {
+	dec := json.NewDecoder(r)
+	tok, err := dec.Token()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return errors.New("empty body")
+		}
+		return err
+	}
+	if tok != json.Delim('{') {
+		return errors.New("expected a JSON object")
+	}
+	for depth := 1; depth > 0; {
+		tok, err := dec.Token()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		switch tok {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+	}
+	if _, err := dec.Token(); !errors.Is(err, io.EOF) {
+		if err != nil {
+			return err
+		}
+		return errors.New("unexpected data after JSON object")
+	}
+	return nil
+}
+
+func bodyReadStatus(err error) int {
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+func StripPrefix(prefix string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.StripPrefix(prefix, next)
+	}
+}
+
+func ParseCIDRs(cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			addr, err := netip.ParseAddr(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR %q: %w", cidr, err)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", cidr, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// clientIP returns the address of the client. With trustProxy, the direct
+// peer is a proxy: the right-most X-Forwarded-For entry is the one it
+// appended, as everything left of it comes from the client. X-Real-IP is
+// only used when there is no X-Forwarded-For, for proxies that set it
+// instead.
+func clientIP(r *http.Request, trustProxy bool) (netip.Addr, error) {
+	if trustProxy {
+		if values := r.Header.Values("X-Forwarded-For"); len(values) > 0 {
+			last := values[len(values)-1]
+			if i := strings.LastIndexByte(last, ','); i >= 0 {
+				last = last[i+1:]
+			}
+			if addr, err := netip.ParseAddr(strings.TrimSpace(last)); err == nil {
+				return addr.Unmap(), nil
+			}
+		} else if xrip := r.Header.Get("X-Real-IP"); xrip != "" {
+			if addr, err := netip.ParseAddr(strings.TrimSpace(xrip)); err == nil {
+				return addr.Unmap(), nil
+			}
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("failed to parse remote address %q: %w", r.RemoteAddr, err)
+	}
+	return addr.Unmap(), nil
+}
+
+func AllowCIDRs(prefixes []netip.Prefix, trustProxy bool) Middleware {
+	return func(next http.Handler) http.Handler {
+		if len(prefixes) == 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			addr, err := clientIP(r, trustProxy)
+			if err == nil {
+				for _, prefix := range prefixes {
+					if prefix.Contains(addr) {
+						next.ServeHTTP(w, r)
+						return
+					}
+				}
+			}
+
+			slog.Warn("rejected request from disallowed address", "remote_addr", r.RemoteAddr, "client_ip", addr.String())
+			http.Error(w, "Forbidden", http.StatusForbidden)
+		})
+	}
+}
+
+type PathRule struct {
+	pattern string
+	glob    bool
+}
+
+func ParsePathRules(patterns []string) ([]PathRule, error) {
+	rules := make([]PathRule, 0, len(patterns))
+	for _, pattern := range patterns {
+		if !strings.HasPrefix(pattern, "/") {
+			pattern = "/" + pattern
+		}
+		glob := strings.ContainsAny(pattern, "*?[")
+		if glob {
+			if _, err := path.Match(pattern, "/"); err != nil {
+				return nil, fmt.Errorf("invalid path pattern %q: %w", pattern, err)
+			}
+		} else {
+			pattern = path.Clean(pattern)
+		}
+		rules = append(rules, PathRule{pattern: pattern, glob: glob})
+	}
+	return rules, nil
+}
+
+func (rule PathRule) match(p string) bool {
+	if rule.glob {
+		ok, _ := path.Match(rule.pattern, p)
+		return ok
+	}
+	return p == rule.pattern || rule.pattern == "/" || strings.HasPrefix(p, rule.pattern+"/")
+}
+
+func matchAnyPath(rules []PathRule, p string) bool {
+	for _, rule := range rules {
+		if rule.match(p) {
+			return true
+		}
+	}
+	return false
+}
+
+func FilterPaths(allow, deny []PathRule) Middleware {
+	return func(next http.Handler) http.Handler {
+		if len(allow) == 0 && len(deny) == 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p := path.Clean(normalizePath(r.URL.Path))
+			if matchAnyPath(deny, p) || (len(allow) > 0 && !matchAnyPath(allow, p)) {
+				writeOpenAIError(w, http.StatusForbidden, "permission_error", fmt.Sprintf("path %s is not allowed", p))
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+type RequestBudget struct {
+	max   int64
+	count atomic.Int64
+}
+
+func NewRequestBudget(max int64) *RequestBudget {
+	return &RequestBudget{max: max}
+}
+
+func (b *RequestBudget) Take() bool {
+	if b.max <= 0 {
+		return true
+	}
+	return b.count.Add(1) <= b.max
+}
+
+func (b *RequestBudget) Exhausted() bool {
+	return b.max > 0 && b.count.Load() >= b.max
+}
+
+func LimitRequests(budget *RequestBudget) Middleware {
+	return func(next http.Handler) http.Handler {
+		if budget.max <= 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !budget.Take() {
+				http.Error(w, fmt.Sprintf("Request limit of %d reached", budget.max), http.StatusTooManyRequests)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+var (
+	errConcurrencyLimit = errors.New("concurrency limit reached")
+	errQueueFull        = errors.New("request queue is full")
+	errQueueTimeout     = errors.New("timed out waiting in request queue")
+)
+
+type ConcurrencyLimiter struct {
+	mu      sync.Mutex
+	max     int
+	active  int
+	depth   int
+	timeout time.Duration
+	waiters *list.List
+}
+
+func NewConcurrencyLimiter(max, depth int, timeout time.Duration) *ConcurrencyLimiter {
+	return &ConcurrencyLimiter{max: max, depth: depth, timeout: timeout, waiters: list.New()}
+}
+
+func (l *ConcurrencyLimiter) Acquire(ctx context.Context) error {
+	l.mu.Lock()
+	if l.active < l.max && l.waiters.Len() == 0 {
+		l.active++
+		l.mu.Unlock()
+		return nil
+	}
+	if l.depth <= 0 {
+		l.mu.Unlock()
+		return errConcurrencyLimit
+	}
+	if l.waiters.Len() >= l.depth {
+		l.mu.Unlock()
+		return errQueueFull
+	}
+	ready := make(chan struct{})
+	elem := l.waiters.PushBack(ready)
+	l.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if l.timeout > 0 {
+		timer := time.NewTimer(l.timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	var err error
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-timeout:
+		err = errQueueTimeout
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	select {
+	case <-ready:
+		// The slot was handed over while we were giving up; pass it on.
+		l.release()
+	default:
+		l.waiters.Remove(elem)
+	}
+	return err
+}
+
+func (l *ConcurrencyLimiter) Release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.release()
+}
+
+func (l *ConcurrencyLimiter) release() {
+	if front := l.waiters.Front(); front != nil {
+		l.waiters.Remove(front)
+		close(front.Value.(chan struct{}))
+		return
+	}
+	l.active--
+}
+
+func (l *ConcurrencyLimiter) Queued() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.waiters.Len()
+}
+
+func LimitConcurrency(limiter *ConcurrencyLimiter) Middleware {
+	return func(next http.Handler) http.Handler {
+		if limiter == nil {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := limiter.Acquire(r.Context()); err != nil {
+				switch {
+				case errors.Is(err, context.Canceled):
+				case errors.Is(err, errConcurrencyLimit):
+					writeOpenAIError(w, http.StatusTooManyRequests, "rate_limit_error", err.Error())
+				default:
+					writeOpenAIError(w, http.StatusServiceUnavailable, "rate_limit_error", err.Error())
+				}
+				return
+			}
+			defer limiter.Release()
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package copilotproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func TestAllowCIDRsClientIP(t *testing.T) {
+	allowed := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	tests := []struct {
+		name       string
+		trustProxy bool
+		remoteAddr string
+		header     http.Header
+		want       int
+	}{
+		{"remote allowed", false, "10.1.2.3:1234", nil, http.StatusOK},
+		{"remote denied", false, "203.0.113.9:1234", nil, http.StatusForbidden},
+		{"untrusted forwarded for", false, "203.0.113.9:1234", http.Header{"X-Forwarded-For": {"10.0.0.1"}}, http.StatusForbidden},
+		{"forwarded for", true, "192.0.2.1:1234", http.Header{"X-Forwarded-For": {"10.0.0.1"}}, http.StatusOK},
+		{"spoofed forwarded for", true, "192.0.2.1:1234", http.Header{"X-Forwarded-For": {"10.0.0.1, 203.0.113.9"}}, http.StatusForbidden},
+		{"spoofed forwarded for header", true, "192.0.2.1:1234", http.Header{"X-Forwarded-For": {"10.0.0.1", "203.0.113.9"}}, http.StatusForbidden},
+		{"forwarded for chain", true, "192.0.2.1:1234", http.Header{"X-Forwarded-For": {"203.0.113.9, 10.0.0.1"}}, http.StatusOK},
+		{"spoofed real ip", true, "192.0.2.1:1234", http.Header{"X-Forwarded-For": {"203.0.113.9"}, "X-Real-Ip": {"10.0.0.1"}}, http.StatusForbidden},
+		{"real ip", true, "192.0.2.1:1234", http.Header{"X-Real-Ip": {"10.0.0.1"}}, http.StatusOK},
+		{"invalid forwarded for", true, "10.1.2.3:1234", http.Header{"X-Forwarded-For": {"unknown"}}, http.StatusOK},
+	}
+
+	handler := AllowCIDRs(allowed, false)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	trusted := AllowCIDRs(allowed, true)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/v1/models", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for name, values := range tt.header {
+				r.Header[name] = values
+			}
+			w := httptest.NewRecorder()
+			if tt.trustProxy {
+				trusted.ServeHTTP(w, r)
+			} else {
+				handler.ServeHTTP(w, r)
+			}
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildChainOrder(t *testing.T) {
+	var order []string
+	mark := func(name string) Middleware {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+	entries := []ChainEntry{
+		{Name: "first", Middleware: mark("first")},
+		{Name: "auth", Middleware: mark("auth"), Required: true},
+		{Name: "middle", Middleware: mark("middle")},
+		{Name: "last", Middleware: mark("last")},
+	}
+
+	tests := []struct {
+		name     string
+		disabled []string
+		want     []string
+		wantErr  bool
+	}{
+		{"all", nil, []string{"first", "auth", "middle", "last"}, false},
+		{"disabled", []string{"middle"}, []string{"first", "auth", "last"}, false},
+		{"disabled twice", []string{"first", "first", "last"}, []string{"auth", "middle"}, false},
+		{"required", []string{"auth"}, nil, true},
+		{"unknown", []string{"nope"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			middlewares, names, err := BuildChain(entries, tt.disabled)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("BuildChain succeeded with %v disabled", tt.disabled)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(names, tt.want) {
+				t.Errorf("names = %v, want %v", names, tt.want)
+			}
+
+			order = nil
+			handler := ApplyMiddlewares(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, "handler")
+			}), middlewares...)
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+			// The first entry is the outermost and runs first.
+			if want := append(slices.Clone(tt.want), "handler"); !slices.Equal(order, want) {
+				t.Errorf("run order = %v, want %v", order, want)
+			}
+		})
+	}
+}
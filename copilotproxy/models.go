@@ -0,0 +1,239 @@
+package copilotproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type modelsList struct {
+	Object string            `json:"object"`
+	Data   []json.RawMessage `json:"data"`
+}
+
+// maxKnownModels bounds knownModels, as models lists come from upstreams.
+const (
+	maxKnownModels = 1024
+	maxModelsBytes = 8 << 20
+)
+
+// knownModels holds the IDs of the models lists served and -default-model,
+// the only models that get their own model label in the request metrics.
+var knownModels = struct {
+	sync.RWMutex
+	ids map[string]struct{}
+}{ids: make(map[string]struct{})}
+
+func addKnownModel(id string) {
+	knownModels.Lock()
+	defer knownModels.Unlock()
+
+	if len(knownModels.ids) < maxKnownModels {
+		knownModels.ids[id] = struct{}{}
+	}
+}
+
+// addKnownModels adds the model IDs of a models list response.
+func addKnownModels(header http.Header, body []byte) {
+	body, err := decodeBody(header.Get("Content-Encoding"), body, maxModelsBytes)
+	if err != nil {
+		return
+	}
+	var list struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	if json.Unmarshal(body, &list) != nil {
+		return
+	}
+	for _, model := range list.Data {
+		if model.ID != "" {
+			addKnownModel(model.ID)
+		}
+	}
+}
+
+// modelLabel returns model if it is known, and "other" otherwise, so that
+// clients cannot create a metric series per made up model name.
+func modelLabel(model string) string {
+	if model == "" {
+		return ""
+	}
+	knownModels.RLock()
+	defer knownModels.RUnlock()
+
+	if _, ok := knownModels.ids[model]; ok {
+		return model
+	}
+	return "other"
+}
+
+// ParseModelsFile reads an OpenAI-style models list, {"object": "list",
+// "data": [{"id": ...}, ...]}, and returns it re-encoded for serving.
+func ParseModelsFile(file string) ([]byte, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read models file: %w", err)
+	}
+	var list modelsList
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("failed to parse models file %s: %w", file, err)
+	}
+	if list.Object != "list" {
+		return nil, fmt.Errorf("invalid models file %s: object is %q, expected \"list\"", file, list.Object)
+	}
+	if list.Data == nil {
+		return nil, fmt.Errorf("invalid models file %s: missing data array", file)
+	}
+	for i, raw := range list.Data {
+		var model struct {
+			ID string `json:"id"`
+		}
+		if err := json.Unmarshal(raw, &model); err != nil {
+			return nil, fmt.Errorf("invalid models file %s: data[%d]: %w", file, i, err)
+		}
+		if model.ID == "" {
+			return nil, fmt.Errorf("invalid models file %s: data[%d] has no id", file, i)
+		}
+	}
+	return json.Marshal(list)
+}
+
+// ModelsBody is the models list StaticModels serves. Store swaps it
+// while the proxy is running; a nil body passes GET /models upstream.
+type ModelsBody struct {
+	body atomic.Pointer[[]byte]
+}
+
+func NewModelsBody(body []byte) *ModelsBody {
+	m := &ModelsBody{}
+	m.Store(body)
+	return m
+}
+
+func (m *ModelsBody) Store(body []byte) {
+	addKnownModels(nil, body)
+	m.body.Store(&body)
+}
+
+func (m *ModelsBody) Load() []byte {
+	if body := m.body.Load(); body != nil {
+		return *body
+	}
+	return nil
+}
+
+// StaticModels answers GET /models with the body of models instead of asking
+// the upstream.
+func StaticModels(models *ModelsBody) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body := models.Load()
+			if body == nil || r.Method != http.MethodGet || strings.TrimSuffix(r.URL.Path, "/") != "/models" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write(body)
+		})
+	}
+}
+
+type bufferedResponse struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (w *bufferedResponse) Header() http.Header {
+	return w.header
+}
+
+func (w *bufferedResponse) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+}
+
+func (w *bufferedResponse) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	return w.body.Write(b)
+}
+
+// CacheModels answers GET /models from the last successful upstream
+// response for up to ttl. Once expired the list is fetched again, and if
+// that fails the stale copy is served instead of the error.
+func CacheModels(ttl time.Duration) Middleware {
+	return func(next http.Handler) http.Handler {
+		if ttl <= 0 {
+			return next
+		}
+		var (
+			mu      sync.Mutex
+			entries = make(map[string]*cachedResponse)
+		)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet || strings.TrimSuffix(r.URL.Path, "/") != "/models" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			key := r.Header.Get("X-Upstream") + "\x00" + r.Header.Get("Accept-Encoding")
+
+			mu.Lock()
+			entry := entries[key]
+			mu.Unlock()
+			if entry != nil && time.Now().Before(entry.expiresAt) {
+				writeCachedResponse(w, entry, "HIT")
+				return
+			}
+
+			rec := &bufferedResponse{header: make(http.Header)}
+			next.ServeHTTP(rec, r)
+			if rec.code == 0 {
+				rec.code = http.StatusOK
+			}
+
+			if rec.code == http.StatusOK && !isEventStream(rec.header) {
+				header := rec.header.Clone()
+				header.Del("Date")
+				entry = &cachedResponse{header: header, body: bytes.Clone(rec.body.Bytes()), expiresAt: time.Now().Add(ttl)}
+				addKnownModels(header, entry.body)
+				mu.Lock()
+				entries[key] = entry
+				mu.Unlock()
+				writeCachedResponse(w, entry, "MISS")
+				return
+			}
+			if entry != nil && (rec.code >= 500 || rec.code == http.StatusTooManyRequests) {
+				slog.Warn("serving stale models list", "status", rec.code, "age", time.Since(entry.expiresAt.Add(-ttl)).Round(time.Second))
+				writeCachedResponse(w, entry, "STALE")
+				return
+			}
+
+			for k, v := range rec.header {
+				w.Header()[k] = v
+			}
+			w.WriteHeader(rec.code)
+			_, _ = w.Write(rec.body.Bytes())
+		})
+	}
+}
+
+func writeCachedResponse(w http.ResponseWriter, entry *cachedResponse, status string) {
+	for k, v := range entry.header {
+		w.Header()[k] = v
+	}
+	w.Header().Set("X-Cache", status)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(entry.body)
+}
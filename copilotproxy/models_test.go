@@ -0,0 +1,57 @@
+package copilotproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestModelLabel(t *testing.T) {
+	StaticModels(NewModelsBody([]byte(`{"object":"list","data":[{"id":"static-model"}]}`)))(http.NotFoundHandler())
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"object":"list","data":[{"id":"cached-model"}]}`))
+	})
+	CacheModels(time.Minute)(upstream).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/models", nil))
+
+	tests := []struct {
+		model string
+		want  string
+	}{
+		{"", ""},
+		{"static-model", "static-model"},
+		{"cached-model", "cached-model"},
+		{"made-up-model", "other"},
+	}
+	for _, tt := range tests {
+		if got := modelLabel(tt.model); got != tt.want {
+			t.Errorf("modelLabel(%q) = %q, want %q", tt.model, got, tt.want)
+		}
+	}
+}
+
+func TestStaticModelsStore(t *testing.T) {
+	models := NewModelsBody(nil)
+	handler := StaticModels(models)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("upstream"))
+	}))
+	serve := func() string {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/models", nil))
+		return w.Body.String()
+	}
+
+	if got := serve(); got != "upstream" {
+		t.Errorf("without models list: body = %q, want %q", got, "upstream")
+	}
+	list := `{"object":"list","data":[{"id":"reloaded-model"}]}`
+	models.Store([]byte(list))
+	if got := serve(); got != list {
+		t.Errorf("after store: body = %q, want %q", got, list)
+	}
+	models.Store(nil)
+	if got := serve(); got != "upstream" {
+		t.Errorf("after clearing: body = %q, want %q", got, "upstream")
+	}
+}
@@ -0,0 +1,500 @@
+package copilotproxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ollamaMessage struct {
+	Role      string           `json:"role"`
+	Content   string           `json:"content"`
+	Images    []string         `json:"images,omitempty"`
+	ToolCalls []ollamaToolCall `json:"tool_calls,omitempty"`
+}
+
+type ollamaToolCall struct {
+	Function struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
+	} `json:"function"`
+}
+
+type ollamaRequest struct {
+	Model    string          `json:"model"`
+	Messages []ollamaMessage `json:"messages"`
+	Prompt   string          `json:"prompt"`
+	System   string          `json:"system"`
+	Images   []string        `json:"images"`
+	Stream   *bool           `json:"stream"`
+	Format   json.RawMessage `json:"format"`
+	Tools    json.RawMessage `json:"tools"`
+	Options  struct {
+		Temperature      *float64        `json:"temperature"`
+		TopP             *float64        `json:"top_p"`
+		NumPredict       *int            `json:"num_predict"`
+		Seed             *int            `json:"seed"`
+		FrequencyPenalty *float64        `json:"frequency_penalty"`
+		PresencePenalty  *float64        `json:"presence_penalty"`
+		Stop             json.RawMessage `json:"stop"`
+	} `json:"options"`
+}
+
+// imageDataURL turns a base64 image as sent by Ollama clients into a data
+// URL, sniffing the media type from its first bytes.
+func imageDataURL(image string) string {
+	head, _ := base64.StdEncoding.DecodeString(image[:min(len(image), 64)/4*4])
+	return "data:" + http.DetectContentType(head) + ";base64," + image
+}
+
+func ollamaChatMessage(msg ollamaMessage) chatMessage {
+	if len(msg.Images) == 0 {
+		return chatMessage{Role: msg.Role, Content: msg.Content}
+	}
+	parts := []chatPart{{Type: "text", Text: msg.Content}}
+	for _, image := range msg.Images {
+		parts = append(parts, chatPart{Type: "image_url", ImageURL: &struct {
+			URL string `json:"url"`
+		}{URL: imageDataURL(image)}})
+	}
+	return chatMessage{Role: msg.Role, Content: parts}
+}
+
+// translateOllamaRequest turns an /api/chat request, or an /api/generate
+// request when generate is set, into a chat completions request.
+func translateOllamaRequest(req *ollamaRequest, generate bool) (map[string]any, error) {
+	var messages []chatMessage
+	if generate {
+		if req.System != "" {
+			messages = append(messages, chatMessage{Role: "system", Content: req.System})
+		}
+		messages = append(messages, ollamaChatMessage(ollamaMessage{Role: "user", Content: req.Prompt, Images: req.Images}))
+	} else {
+		// Ollama tool results carry no call ID; pair them with the calls of
+		// the preceding assistant message in order.
+		var pending []string
+		calls := 0
+		for _, msg := range req.Messages {
+			out := ollamaChatMessage(msg)
+			switch {
+			case msg.Role == "assistant" && len(msg.ToolCalls) > 0:
+				pending = pending[:0]
+				for _, call := range msg.ToolCalls {
+					calls++
+					id := "call_" + strconv.Itoa(calls)
+					pending = append(pending, id)
+					toolCall := chatToolCall{ID: id, Type: "function"}
+					toolCall.Function.Name = call.Function.Name
+					toolCall.Function.Arguments = "{}"
+					if len(call.Function.Arguments) > 0 && string(call.Function.Arguments) != "null" {
+						toolCall.Function.Arguments = string(call.Function.Arguments)
+					}
+					out.ToolCalls = append(out.ToolCalls, toolCall)
+				}
+			case msg.Role == "tool" && len(pending) > 0:
+				out.ToolCallID, pending = pending[0], pending[1:]
+			}
+			messages = append(messages, out)
+		}
+	}
+
+	out := map[string]any{
+		"model":    req.Model,
+		"messages": messages,
+	}
+	stream := req.Stream == nil || *req.Stream
+	if stream {
+		out["stream"] = true
+		out["stream_options"] = map[string]any{"include_usage": true}
+	}
+	if len(req.Tools) > 0 && string(req.Tools) != "null" {
+		out["tools"] = req.Tools
+	}
+	opts := req.Options
+	if opts.Temperature != nil {
+		out["temperature"] = *opts.Temperature
+	}
+	if opts.TopP != nil {
+		out["top_p"] = *opts.TopP
+	}
+	if opts.NumPredict != nil && *opts.NumPredict > 0 {
+		out["max_tokens"] = *opts.NumPredict
+	}
+	if opts.Seed != nil {
+		out["seed"] = *opts.Seed
+	}
+	if opts.FrequencyPenalty != nil {
+		out["frequency_penalty"] = *opts.FrequencyPenalty
+	}
+	if opts.PresencePenalty != nil {
+		out["presence_penalty"] = *opts.PresencePenalty
+	}
+	if len(opts.Stop) > 0 && string(opts.Stop) != "null" {
+		out["stop"] = opts.Stop
+	}
+	switch format := strings.TrimSpace(string(req.Format)); {
+	case format == "" || format == "null" || format == `""`:
+	case format == `"json"`:
+		out["response_format"] = map[string]any{"type": "json_object"}
+	case strings.HasPrefix(format, "{"):
+		out["response_format"] = map[string]any{"type": "json_schema", "json_schema": map[string]any{"name": "response", "schema": req.Format}}
+	default:
+		return nil, fmt.Errorf("unsupported format %s", format)
+	}
+	return out, nil
+}
+
+func writeOllamaError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
+
+func ollamaDoneReason(finishReason string) string {
+	if finishReason == "length" {
+		return "length"
+	}
+	return "stop"
+}
+
+func ollamaToolCalls(calls []chatToolCall) []ollamaToolCall {
+	out := make([]ollamaToolCall, 0, len(calls))
+	for _, call := range calls {
+		var toolCall ollamaToolCall
+		toolCall.Function.Name = call.Function.Name
+		toolCall.Function.Arguments = toolInput(call.Function.Arguments)
+		out = append(out, toolCall)
+	}
+	return out
+}
+
+// ollamaWriter receives the chat completions response from the API handler
+// and writes it to the client as an Ollama response, streamed as
+// newline-delimited JSON.
+type ollamaWriter struct {
+	w        http.ResponseWriter
+	header   http.Header
+	code     int
+	model    string
+	generate bool
+	start    time.Time
+
+	streaming bool
+	buf       bytes.Buffer
+	data      sseData
+	done      bool
+	toolCalls map[int]*chatToolCall
+	order     []int
+	reason    string
+	usage     *chatUsage
+}
+
+func (ow *ollamaWriter) Header() http.Header {
+	return ow.header
+}
+
+func (ow *ollamaWriter) WriteHeader(code int) {
+	if ow.code != 0 {
+		return
+	}
+	ow.code = code
+	if code == http.StatusOK && isEventStream(ow.header) {
+		ow.streaming = true
+		copyTranslatedHeaders(ow.w.Header(), ow.header)
+		ow.w.Header().Set("Content-Type", "application/x-ndjson")
+		ow.w.WriteHeader(http.StatusOK)
+		ow.toolCalls = make(map[int]*chatToolCall)
+	}
+}
+
+func (ow *ollamaWriter) Write(b []byte) (int, error) {
+	if ow.code == 0 {
+		ow.WriteHeader(http.StatusOK)
+	}
+	if ow.streaming {
+		if err := ow.data.feed(b, ow.chunk); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	return ow.buf.Write(b)
+}
+
+func (ow *ollamaWriter) Flush() {
+	if ow.streaming {
+		_ = http.NewResponseController(ow.w).Flush()
+	}
+}
+
+// response builds an Ollama response object carrying content.
+func (ow *ollamaWriter) response(content string, toolCalls []ollamaToolCall, done bool) map[string]any {
+	out := map[string]any{
+		"model":      ow.model,
+		"created_at": time.Now().UTC().Format(time.RFC3339Nano),
+		"done":       done,
+	}
+	if ow.generate {
+		out["response"] = content
+	} else {
+		message := map[string]any{"role": "assistant", "content": content}
+		if len(toolCalls) > 0 {
+			message["tool_calls"] = toolCalls
+		}
+		out["message"] = message
+	}
+	if done {
+		out["done_reason"] = ow.reason
+		out["total_duration"] = time.Since(ow.start).Nanoseconds()
+		if ow.usage != nil {
+			out["prompt_eval_count"] = ow.usage.PromptTokens
+			out["eval_count"] = ow.usage.CompletionTokens
+		}
+	}
+	return out
+}
+
+func (ow *ollamaWriter) line(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = ow.w.Write(append(data, '\n'))
+	return err
+}
+
+func (ow *ollamaWriter) chunk(data string) error {
+	if ow.done || data == "" {
+		return nil
+	}
+	if data == "[DONE]" {
+		return ow.stop()
+	}
+	var chunk chatCompletion
+	if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+		return nil
+	}
+	if chunk.Error != nil {
+		ow.done = true
+		return ow.line(map[string]string{"error": chunk.Error.Message})
+	}
+	if chunk.Usage != nil {
+		ow.usage = chunk.Usage
+	}
+	for _, choice := range chunk.Choices {
+		for _, call := range choice.Delta.ToolCalls {
+			index := 0
+			if call.Index != nil {
+				index = *call.Index
+			}
+			acc, ok := ow.toolCalls[index]
+			if !ok {
+				acc = &chatToolCall{}
+				ow.toolCalls[index] = acc
+				ow.order = append(ow.order, index)
+			}
+			if call.Function.Name != "" {
+				acc.Function.Name = call.Function.Name
+			}
+			acc.Function.Arguments += call.Function.Arguments
+		}
+		if choice.FinishReason != nil && *choice.FinishReason != "" {
+			ow.reason = ollamaDoneReason(*choice.FinishReason)
+		}
+		if text := choice.Delta.Content; text != nil && *text != "" {
+			if err := ow.line(ow.response(*text, nil, false)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (ow *ollamaWriter) stop() error {
+	if ow.done {
+		return nil
+	}
+	ow.done = true
+	if ow.reason == "" {
+		ow.reason = "stop"
+	}
+	if len(ow.order) > 0 {
+		calls := make([]chatToolCall, 0, len(ow.order))
+		for _, index := range ow.order {
+			calls = append(calls, *ow.toolCalls[index])
+		}
+		if err := ow.line(ow.response("", ollamaToolCalls(calls), false)); err != nil {
+			return err
+		}
+	}
+	return ow.line(ow.response("", nil, true))
+}
+
+func (ow *ollamaWriter) finish() {
+	if ow.code == 0 {
+		ow.code = http.StatusOK
+	}
+	if ow.streaming {
+		_ = ow.data.flush(ow.chunk)
+		_ = ow.stop()
+		_ = http.NewResponseController(ow.w).Flush()
+		return
+	}
+	copyTranslatedHeaders(ow.w.Header(), ow.header)
+	if ow.code != http.StatusOK {
+		writeOllamaError(ow.w, ow.code, upstreamErrorMessage(ow.buf.Bytes()))
+		return
+	}
+	var completion chatCompletion
+	if err := json.Unmarshal(ow.buf.Bytes(), &completion); err != nil {
+		writeOllamaError(ow.w, http.StatusBadGateway, "failed to parse upstream response: "+err.Error())
+		return
+	}
+	ow.usage = completion.Usage
+	ow.reason = "stop"
+	var content strings.Builder
+	var calls []chatToolCall
+	for _, choice := range completion.Choices {
+		if choice.Message.Content != nil {
+			content.WriteString(*choice.Message.Content)
+		}
+		calls = append(calls, choice.Message.ToolCalls...)
+		if choice.FinishReason != nil {
+			ow.reason = ollamaDoneReason(*choice.FinishReason)
+		}
+	}
+	var toolCalls []ollamaToolCall
+	if len(calls) > 0 {
+		toolCalls = ollamaToolCalls(calls)
+	}
+	body, _ := json.Marshal(ow.response(content.String(), toolCalls, true))
+	ow.w.Header().Set("Content-Type", "application/json")
+	ow.w.WriteHeader(http.StatusOK)
+	_, _ = ow.w.Write(body)
+}
+
+// OllamaChat serves the Ollama /api/chat endpoint, or /api/generate when
+// generate is set, on top of api, which must accept chat completions
+// requests at path. Like AnthropicMessages, it reads the request before the
+// api chain does, so auth and the body limit belong in front of it.
+func OllamaChat(api http.Handler, path string, generate bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxTranslatedBodyBytes))
+		if err != nil {
+			writeOllamaError(w, bodyReadStatus(err), "failed to read request body")
+			return
+		}
+		var req ollamaRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			writeOllamaError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+			return
+		}
+		if req.Model == "" {
+			writeOllamaError(w, http.StatusBadRequest, "model is required")
+			return
+		}
+		translated, err := translateOllamaRequest(&req, generate)
+		if err != nil {
+			writeOllamaError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		data, err := json.Marshal(translated)
+		if err != nil {
+			writeOllamaError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		out := r.Clone(r.Context())
+		out.URL.Path = path
+		out.URL.RawPath = ""
+		out.Body = io.NopCloser(bytes.NewReader(data))
+		out.ContentLength = int64(len(data))
+		out.Header.Set("Content-Type", "application/json")
+		out.Header.Del("Content-Encoding")
+		out.Header.Del("Accept-Encoding")
+
+		ow := &ollamaWriter{w: w, header: make(http.Header), model: req.Model, generate: generate, start: time.Now()}
+		api.ServeHTTP(ow, out)
+		ow.finish()
+	})
+}
+
+// OllamaTags serves the Ollama /api/tags model list from the models list
+// api returns at path.
+func OllamaTags(api http.Handler, path string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		out := r.Clone(r.Context())
+		out.Method = http.MethodGet
+		out.URL.Path = path
+		out.URL.RawPath = ""
+		out.Body = http.NoBody
+		out.ContentLength = 0
+		out.Header.Del("Accept-Encoding")
+
+		rec := &bufferedResponse{header: make(http.Header)}
+		api.ServeHTTP(rec, out)
+		if rec.code == 0 {
+			rec.code = http.StatusOK
+		}
+		if rec.code != http.StatusOK {
+			writeOllamaError(w, rec.code, upstreamErrorMessage(rec.body.Bytes()))
+			return
+		}
+		var list struct {
+			Data []struct {
+				ID string `json:"id"`
+			} `json:"data"`
+		}
+		if err := json.Unmarshal(rec.body.Bytes(), &list); err != nil {
+			writeOllamaError(w, http.StatusBadGateway, "failed to parse upstream models list: "+err.Error())
+			return
+		}
+		models := make([]map[string]any, 0, len(list.Data))
+		seen := make(map[string]bool, len(list.Data))
+		for _, model := range list.Data {
+			if model.ID == "" || seen[model.ID] {
+				continue
+			}
+			seen[model.ID] = true
+			models = append(models, map[string]any{
+				"name":        model.ID,
+				"model":       model.ID,
+				"modified_at": time.Time{}.Format(time.RFC3339),
+				"size":        0,
+				"digest":      "",
+				"details":     map[string]any{"format": "", "family": "copilot", "parameter_size": "", "quantization_level": ""},
+			})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{"models": models})
+	})
+}
+
+// OllamaShow answers /api/show for any model name. Copilot does not
+// publish model details, so only the capabilities every chat model has are
+// reported.
+func OllamaShow(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Model string `json:"model"`
+		Name  string `json:"name"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil {
+		writeOllamaError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"modelfile":    "",
+		"parameters":   "",
+		"template":     "",
+		"details":      map[string]any{"format": "", "family": "copilot", "parameter_size": "", "quantization_level": ""},
+		"model_info":   map[string]any{"general.architecture": "copilot"},
+		"capabilities": []string{"completion", "tools", "vision"},
+	})
+}
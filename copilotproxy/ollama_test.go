@@ -0,0 +1,285 @@
+package copilotproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOllamaAuthBeforeRead(t *testing.T) {
+	keys, err := NewAccessKeys(&AccessKey{Name: "alice", Token: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var called bool
+	api := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/models" {
+			_, _ = w.Write([]byte(`{"object":"list","data":[{"id":"gpt-4o"}]}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"id":"1","model":"gpt-4o","choices":[{"message":{"role":"assistant","content":"hi"},"finish_reason":"stop"}]}`))
+	})
+	middlewares := []Middleware{TrackRequestInfo, VerifyAccessToken(keys, nil), LimitBody(128)}
+	chat := ApplyMiddlewares(OllamaChat(api, "/chat/completions", false), middlewares...)
+	tags := ApplyMiddlewares(OllamaTags(api, "/models"), middlewares...)
+	body := `{"model":"gpt-4o","stream":false,"messages":[{"role":"user","content":"hello"}]}`
+
+	tests := []struct {
+		name    string
+		handler http.Handler
+		method  string
+		token   string
+		body    string
+		want    int
+	}{
+		{"chat without token", chat, http.MethodPost, "", body, http.StatusUnauthorized},
+		{"chat body too large", chat, http.MethodPost, "secret", body + strings.Repeat(" ", 128), http.StatusRequestEntityTooLarge},
+		{"chat", chat, http.MethodPost, "secret", body, http.StatusOK},
+		{"tags without token", tags, http.MethodGet, "", "", http.StatusUnauthorized},
+		{"tags", tags, http.MethodGet, "secret", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			called = false
+			r := httptest.NewRequest(tt.method, "/api/chat", strings.NewReader(tt.body))
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			tt.handler.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if called != (tt.want == http.StatusOK) {
+				t.Errorf("api called = %v", called)
+			}
+		})
+	}
+}
+
+func TestTranslateOllamaRequest(t *testing.T) {
+	tests := []struct {
+		name     string
+		req      string
+		generate bool
+		want     string
+		wantErr  string
+	}{
+		{
+			name: "tool call IDs",
+			req: `{"model":"llama3","stream":false,"messages":[
+				{"role":"user","content":"Weather in Paris and Rome?"},
+				{"role":"assistant","content":"","tool_calls":[{"function":{"name":"get_weather","arguments":{"city":"Paris"}}},{"function":{"name":"get_weather","arguments":{"city":"Rome"}}}]},
+				{"role":"tool","content":"Sunny"},
+				{"role":"tool","content":"Rainy"},
+				{"role":"assistant","content":"","tool_calls":[{"function":{"name":"get_time","arguments":null}}]},
+				{"role":"tool","content":"Noon"},
+				{"role":"tool","content":"Unpaired"}]}`,
+			want: `{"model":"llama3","messages":[
+				{"role":"user","content":"Weather in Paris and Rome?"},
+				{"role":"assistant","content":"","tool_calls":[{"id":"call_1","type":"function","function":{"name":"get_weather","arguments":"{\"city\":\"Paris\"}"}},{"id":"call_2","type":"function","function":{"name":"get_weather","arguments":"{\"city\":\"Rome\"}"}}]},
+				{"role":"tool","tool_call_id":"call_1","content":"Sunny"},
+				{"role":"tool","tool_call_id":"call_2","content":"Rainy"},
+				{"role":"assistant","content":"","tool_calls":[{"id":"call_3","type":"function","function":{"name":"get_time","arguments":"{}"}}]},
+				{"role":"tool","tool_call_id":"call_3","content":"Noon"},
+				{"role":"tool","content":"Unpaired"}]}`,
+		},
+		{
+			name: "options",
+			req:  `{"model":"llama3","stream":false,"messages":[{"role":"user","content":"Hi"}],"options":{"temperature":0.2,"top_p":0.9,"num_predict":128,"seed":42,"frequency_penalty":0.5,"presence_penalty":0.1,"stop":["END"]}}`,
+			want: `{"model":"llama3","messages":[{"role":"user","content":"Hi"}],"temperature":0.2,"top_p":0.9,"max_tokens":128,"seed":42,"frequency_penalty":0.5,"presence_penalty":0.1,"stop":["END"]}`,
+		},
+		{
+			name: "streamed by default, unlimited num_predict",
+			req:  `{"model":"llama3","messages":[{"role":"user","content":"Hi"}],"options":{"num_predict":-1}}`,
+			want: `{"model":"llama3","stream":true,"stream_options":{"include_usage":true},"messages":[{"role":"user","content":"Hi"}]}`,
+		},
+		{
+			name: "format json",
+			req:  `{"model":"llama3","stream":false,"format":"json","messages":[{"role":"user","content":"Hi"}]}`,
+			want: `{"model":"llama3","response_format":{"type":"json_object"},"messages":[{"role":"user","content":"Hi"}]}`,
+		},
+		{
+			name: "format schema",
+			req:  `{"model":"llama3","stream":false,"format":{"type":"object","properties":{"age":{"type":"integer"}}},"messages":[{"role":"user","content":"Hi"}]}`,
+			want: `{"model":"llama3","response_format":{"type":"json_schema","json_schema":{"name":"response","schema":{"type":"object","properties":{"age":{"type":"integer"}}}}},"messages":[{"role":"user","content":"Hi"}]}`,
+		},
+		{
+			name:    "unsupported format",
+			req:     `{"model":"llama3","format":"yaml","messages":[{"role":"user","content":"Hi"}]}`,
+			wantErr: `unsupported format "yaml"`,
+		},
+		{
+			name:     "generate",
+			generate: true,
+			req:      `{"model":"llava","stream":false,"system":"Be brief.","prompt":"Describe","images":["iVBORw0KGgo="]}`,
+			want: `{"model":"llava","messages":[
+				{"role":"system","content":"Be brief."},
+				{"role":"user","content":[{"type":"text","text":"Describe"},{"type":"image_url","image_url":{"url":"data:image/png;base64,iVBORw0KGgo="}}]}]}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var req ollamaRequest
+			if err := json.Unmarshal([]byte(tt.req), &req); err != nil {
+				t.Fatal(err)
+			}
+			out, err := translateOllamaRequest(&req, tt.generate)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertJSONEqual(t, out, tt.want)
+		})
+	}
+}
+
+func TestOllamaStream(t *testing.T) {
+	tests := []struct {
+		name     string
+		generate bool
+		chunks   []string
+		want     []string
+	}{
+		{
+			name: "chat with tool calls",
+			chunks: []string{
+				`{"choices":[{"index":0,"delta":{"role":"assistant","content":"Let me check."}}]}`,
+				`{"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"id":"call_a","type":"function","function":{"name":"get_weather","arguments":"{\"city\":"}}]}}]}`,
+				`{"choices":[{"index":0,"delta":{"tool_calls":[{"index":1,"id":"call_b","type":"function","function":{"name":"get_time","arguments":""}}]}}]}`,
+				`{"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"\"Paris\"}"}}]}}]}`,
+				`{"choices":[{"index":0,"delta":{},"finish_reason":"tool_calls"}]}`,
+				`{"choices":[],"usage":{"prompt_tokens":12,"completion_tokens":7}}`,
+				`[DONE]`,
+			},
+			want: []string{
+				`{"done":false,"message":{"content":"Let me check.","role":"assistant"},"model":"llama3"}`,
+				`{"done":false,"message":{"content":"","role":"assistant","tool_calls":[{"function":{"arguments":{"city":"Paris"},"name":"get_weather"}},{"function":{"arguments":{},"name":"get_time"}}]},"model":"llama3"}`,
+				`{"done":true,"done_reason":"stop","eval_count":7,"message":{"content":"","role":"assistant"},"model":"llama3","prompt_eval_count":12}`,
+			},
+		},
+		{
+			name:     "generate cut off without DONE",
+			generate: true,
+			chunks: []string{
+				`{"choices":[{"index":0,"delta":{"content":"Once"}}]}`,
+				`{"choices":[{"index":0,"delta":{"content":" upon"},"finish_reason":"length"}]}`,
+			},
+			want: []string{
+				`{"done":false,"model":"llama3","response":"Once"}`,
+				`{"done":false,"model":"llama3","response":" upon"}`,
+				`{"done":true,"done_reason":"length","model":"llama3","response":""}`,
+			},
+		},
+		{
+			name: "upstream error",
+			chunks: []string{
+				`{"choices":[{"index":0,"delta":{"content":"Hi"}}]}`,
+				`{"error":{"message":"upstream overloaded"}}`,
+				`[DONE]`,
+			},
+			want: []string{
+				`{"done":false,"message":{"content":"Hi","role":"assistant"},"model":"llama3"}`,
+				`{"error":"upstream overloaded"}`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			ow := &ollamaWriter{w: w, header: make(http.Header), model: "llama3", generate: tt.generate, start: time.Now()}
+			ow.Header().Set("Content-Type", "text/event-stream")
+			ow.WriteHeader(http.StatusOK)
+			feedInPieces(t, func(b []byte) error {
+				_, err := ow.Write(b)
+				return err
+			}, tt.chunks...)
+			ow.finish()
+
+			if got := w.Header().Get("Content-Type"); got != "application/x-ndjson" {
+				t.Errorf("Content-Type = %q, want application/x-ndjson", got)
+			}
+			var got []string
+			for _, line := range strings.Split(strings.TrimSuffix(w.Body.String(), "\n"), "\n") {
+				var response map[string]any
+				if err := json.Unmarshal([]byte(line), &response); err != nil {
+					t.Fatalf("malformed line %q: %v", line, err)
+				}
+				// Timestamps and durations vary from run to run.
+				delete(response, "created_at")
+				delete(response, "total_duration")
+				data, _ := json.Marshal(response)
+				got = append(got, string(data))
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("lines:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestOllamaScopes(t *testing.T) {
+	var parsed []*AccessKey
+	for _, value := range []string{"chatter:chat-secret:chat", "lister:models-secret:models"} {
+		key, err := ParseAccessKey(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed = append(parsed, key)
+	}
+	keys, err := NewAccessKeys(parsed...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := ApplyMiddlewares(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/models" {
+			_, _ = w.Write([]byte(`{"object":"list","data":[{"id":"gpt-4o"}]}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"id":"1","model":"gpt-4o","choices":[{"message":{"role":"assistant","content":"hi"},"finish_reason":"stop"}]}`))
+	}), TrackRequestInfo, VerifyAccessToken(keys, nil))
+	middlewares := []Middleware{TrackRequestInfo, AuthenticateAccessToken(keys, nil)}
+	chat := ApplyMiddlewares(OllamaChat(api, "/chat/completions", false), middlewares...)
+	tags := ApplyMiddlewares(OllamaTags(api, "/models"), middlewares...)
+
+	tests := []struct {
+		name    string
+		handler http.Handler
+		method  string
+		token   string
+		want    int
+	}{
+		{"chat with chat scope", chat, http.MethodPost, "chat-secret", http.StatusOK},
+		{"chat with models scope", chat, http.MethodPost, "models-secret", http.StatusForbidden},
+		{"tags with models scope", tags, http.MethodGet, "models-secret", http.StatusOK},
+		{"tags with chat scope", tags, http.MethodGet, "chat-secret", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/api/chat", strings.NewReader(`{"model":"gpt-4o","stream":false,"messages":[{"role":"user","content":"hello"}]}`))
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+			w := httptest.NewRecorder()
+			tt.handler.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+	for _, status := range keys.Status() {
+		if status.Requests != 2 {
+			t.Errorf("%s: %d requests recorded, want 2", status.Name, status.Requests)
+		}
+	}
+}
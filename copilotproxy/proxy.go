@@ -0,0 +1,649 @@
+package copilotproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func (ts *TokenSource) rewriteRequest(r *httputil.ProxyRequest, upstream *url.URL) {
+	if selected := ts.selectUpstream(r.In.Header.Get("X-Upstream")); selected != nil {
+		upstream = selected
+		requestInfoFrom(r.In.Context()).pinned = true
+	}
+	r.Out.Header.Del("X-Upstream")
+	setUpstreamURL(r, upstream)
+	ts.CustomHeaders(r.Out.Header)
+	if id := r.In.Header.Get("X-Copilot-Integration"); id != "" && slices.Contains(ts.AllowedIntegrationIDs, id) {
+		r.Out.Header.Set("Copilot-Integration-Id", id)
+	}
+	r.Out.Header.Del("X-Copilot-Integration")
+	completion := r.Out.Method == http.MethodPost && isCompletionPath(r.In.URL.Path)
+	forceNonStream, _ := strconv.ParseBool(r.In.Header.Get("X-Force-Non-Stream"))
+	forceNonStream = forceNonStream && completion
+	r.Out.Header.Del("X-Force-Non-Stream")
+	if forceNonStream {
+		requestInfoFrom(r.In.Context()).stream = false
+	}
+	info := requestInfoFrom(r.In.Context())
+	if info.stream {
+		r.Out.Header.Set("Accept", "text/event-stream")
+	}
+	countStreamUsage := completion && info.stream && info.countUsage
+	if countStreamUsage {
+		// Let the transport decompress the stream so its usage can be read.
+		r.Out.Header.Del("Accept-Encoding")
+	}
+	if completion {
+		info.stripUsage = ts.rewriteBody(r.Out, forceNonStream, countStreamUsage)
+	}
+}
+
+// rewriteBody applies the configured changes to a completion request body.
+// Bodies that are not a JSON object are forwarded untouched. With
+// includeUsage, streams are asked to end with a usage chunk; it reports
+// whether the client had not asked for that chunk itself.
+func (ts *TokenSource) rewriteBody(out *http.Request, forceNonStream, includeUsage bool) (addedUsage bool) {
+	if (ts.DefaultModel == "" && !forceNonStream && !includeUsage) || out.Body == nil || out.Body == http.NoBody {
+		return false
+	}
+	body, err := io.ReadAll(out.Body)
+	_ = out.Body.Close()
+	out.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return false
+	}
+
+	var payload map[string]json.RawMessage
+	if err := json.Unmarshal(body, &payload); err != nil || payload == nil {
+		return false
+	}
+	changed := false
+	if ts.DefaultModel != "" {
+		var model string
+		if err := json.Unmarshal(payload["model"], &model); err != nil || model == "" {
+			payload["model"], _ = json.Marshal(ts.DefaultModel)
+			changed = true
+		}
+	}
+	if forceNonStream {
+		var stream bool
+		if err := json.Unmarshal(payload["stream"], &stream); err == nil && stream {
+			payload["stream"] = json.RawMessage("false")
+			changed = true
+		}
+		// stream_options is rejected unless stream is true.
+		if _, ok := payload["stream_options"]; ok {
+			delete(payload, "stream_options")
+			changed = true
+		}
+	}
+	if includeUsage && !forceNonStream {
+		var options map[string]json.RawMessage
+		_ = json.Unmarshal(payload["stream_options"], &options)
+		var included bool
+		if err := json.Unmarshal(options["include_usage"], &included); err != nil || !included {
+			if options == nil {
+				options = make(map[string]json.RawMessage)
+			}
+			options["include_usage"] = json.RawMessage("true")
+			payload["stream_options"], _ = json.Marshal(options)
+			changed, addedUsage = true, true
+		}
+	}
+	if !changed {
+		return false
+	}
+	body, err = json.Marshal(payload)
+	if err != nil {
+		return false
+	}
+	out.Body = io.NopCloser(bytes.NewReader(body))
+	out.ContentLength = int64(len(body))
+	out.Header.Del("Content-Length")
+	return addedUsage
+}
+
+func (ts *TokenSource) selectUpstream(value string) *url.URL {
+	if value == "" {
+		return nil
+	}
+	value = strings.TrimSuffix(value, "/")
+	for _, upstream := range ts.AllowedUpstreams {
+		if strings.TrimSuffix(upstream.String(), "/") == value {
+			return upstream
+		}
+	}
+	return nil
+}
+
+// NewProxy returns a handler proxying requests to the Copilot API. With
+// several upstreams, later ones are tried when earlier ones fail.
+func (ts *TokenSource) NewProxy(upstreams ...*url.URL) http.Handler {
+	if ts.DefaultModel != "" {
+		addKnownModel(ts.DefaultModel)
+	}
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			ts.rewriteRequest(r, upstreams[0])
+		},
+		Transport: recordUpstream{newRetryTransport(ts.Retry, newFailoverTransport(upstreams, newTokenRetryTransport(ts, upstreams[0], ts.transport)))},
+		ModifyResponse: func(rsp *http.Response) error {
+			for _, hook := range ts.ResponseHooks {
+				if err := hook(rsp); err != nil {
+					return err
+				}
+			}
+			if err := bufferResponse(rsp, ts.BufferResponseBytes); err != nil {
+				return err
+			}
+			if err := guardEventStream(rsp); err != nil {
+				return err
+			}
+			if ts.SSEKeepalive > 0 && isEventStream(rsp.Header) {
+				rsp.Body = newKeepaliveBody(rsp.Body, ts.SSEKeepalive)
+			}
+			return nil
+		},
+		ErrorHandler: handleProxyError,
+	}
+	if ts.BufferResponseBytes > 0 {
+		proxy.FlushInterval = -1
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ts.Ready() {
+			http.Error(w, "Service not ready", http.StatusServiceUnavailable)
+			return
+		}
+		r, info := withRequestInfo(r)
+		info.inbound = r.URL
+		if r.Method == http.MethodPost && isCompletionPath(r.URL.Path) {
+			body, err := readBody(r)
+			if err != nil {
+				http.Error(w, "Failed to read request body", bodyReadStatus(err))
+				return
+			}
+			info.stream = isStreamRequest(body)
+			info.model = requestModel(body)
+			if info.model == "" {
+				info.model = ts.DefaultModel
+			}
+		}
+
+		tracker := TrackStatusCode(w)
+		start := time.Now()
+		inFlight.Add(1)
+
+		defer func() {
+			inFlight.Add(-1)
+			stream := info.stream || isEventStream(tracker.Header())
+			requestsTotal.Inc(r.Method, strconv.Itoa(tracker.code), strconv.FormatBool(stream), modelLabel(info.model))
+			requestDuration.Observe(time.Since(start).Seconds(), r.Method, strconv.FormatBool(stream))
+
+			if errors.Is(r.Context().Err(), context.Canceled) || tracker.writeErr != nil {
+				clientDisconnects.Inc(strconv.FormatBool(stream))
+				slog.Warn("client disconnected", "method", r.Method, "url", r.URL.String(), "stream", stream, "bytes", tracker.bytes, "elapsed", time.Since(start).String(), "status", tracker.code, "request_id", r.Header.Get("X-Request-Id"), "key", info.key)
+			}
+
+			latency := time.Since(start)
+			if stream {
+				latency = tracker.TTFB(start)
+			}
+			level := slog.LevelInfo
+			attrs := []any{"method", r.Method, "url", r.URL.String(), "original_uri", info.originalURI, "upstream_path", info.upstreamPath, "ttfb", tracker.TTFB(start).String(), "duration", time.Since(start).String(), "bytes", tracker.bytes, "status", tracker.code, "stream", stream, "upstream", info.upstream, "upstream_selected", info.pinned, "request_id", r.Header.Get("X-Request-Id"), "key", info.key, "account", info.account, "name", "accesslog"}
+			if ts.SlowRequestThreshold > 0 && latency > ts.SlowRequestThreshold {
+				level = slog.LevelWarn
+				attrs = append(attrs, "slow", true)
+			} else if !ts.sampleAccessLog(tracker.code) {
+				return
+			}
+			slog.Log(r.Context(), level, "proxied request", attrs...)
+		}()
+
+		proxy.ServeHTTP(tracker, r)
+	})
+}
+
+func setUpstreamURL(r *httputil.ProxyRequest, upstream *url.URL) {
+	r.Out.URL.Path = normalizePath(r.Out.URL.Path)
+	r.Out.URL.RawPath = ""
+	r.SetURL(upstream)
+}
+
+func normalizePath(p string) string {
+	if p == "" {
+		return "/"
+	}
+	var b strings.Builder
+	b.Grow(len(p) + 1)
+	if p[0] != '/' {
+		b.WriteByte('/')
+	}
+	for i := 0; i < len(p); i++ {
+		if p[i] == '/' && i > 0 && p[i-1] == '/' {
+			continue
+		}
+		b.WriteByte(p[i])
+	}
+	return b.String()
+}
+
+type requestInfo struct {
+	originalURI  string
+	inbound      *url.URL
+	upstream     string
+	upstreamPath string
+	stream       bool
+	model        string
+	account      string
+	pinned       bool
+	key          string
+
+	countUsage bool
+	stripUsage bool
+	// quotaReserved is set while EnforceQuotas counts the request in flight,
+	// so a translated request passing it twice is only counted once.
+	quotaReserved bool
+
+	// upstreamDone is set once the request went upstream, with the final
+	// status in upstreamCode, or 0 if it failed without a response.
+	upstreamDone bool
+	upstreamCode int
+
+	promptTokens     int64
+	completionTokens int64
+}
+
+type requestInfoKey struct{}
+
+func withRequestInfo(r *http.Request) (*http.Request, *requestInfo) {
+	if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+		return r, info
+	}
+	info := &requestInfo{originalURI: r.RequestURI, inbound: r.URL}
+	return r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info)), info
+}
+
+func TrackRequestInfo(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r, _ = withRequestInfo(r)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func requestInfoFrom(ctx context.Context) *requestInfo {
+	if info, ok := ctx.Value(requestInfoKey{}).(*requestInfo); ok {
+		return info
+	}
+	return &requestInfo{}
+}
+
+type openAIError struct {
+	Error openAIErrorBody `json:"error"`
+}
+
+type openAIErrorBody struct {
+	Message string `json:"message"`
+	Type    string `json:"type"`
+	Code    string `json:"code,omitempty"`
+}
+
+func writeOpenAIError(w http.ResponseWriter, code int, typ, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(openAIError{Error: openAIErrorBody{Message: message, Type: typ}})
+}
+
+func sseErrorEvent(message string) []byte {
+	data, _ := json.Marshal(openAIError{Error: openAIErrorBody{Message: message, Type: "upstream_error"}})
+	return []byte("data: " + string(data) + "\n\n")
+}
+
+func isEventStream(header http.Header) bool {
+	return strings.HasPrefix(header.Get("Content-Type"), "text/event-stream")
+}
+
+func upstreamErrorStatus(err error) (int, string) {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return http.StatusGatewayTimeout, "upstream request timed out"
+	}
+	return http.StatusBadGateway, "upstream request failed"
+}
+
+func handleProxyError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(r.Context().Err(), context.Canceled) {
+		slog.Debug("client went away", "url", r.URL.String(), "error", err)
+		return
+	}
+	slog.Error("upstream request failed", "url", r.URL.String(), "error", err)
+
+	// ReverseProxy only calls this before the response headers are written;
+	// streams failing later are ended by eventStreamBody instead.
+	code, message := upstreamErrorStatus(err)
+	writeOpenAIError(w, code, "upstream_error", message+": "+err.Error())
+}
+
+func bufferResponse(rsp *http.Response, max int64) error {
+	if max <= 0 || rsp.ContentLength >= 0 || isEventStream(rsp.Header) || rsp.Body == nil || rsp.Body == http.NoBody {
+		return nil
+	}
+
+	data, err := io.ReadAll(io.LimitReader(rsp.Body, max+1))
+	if err != nil {
+		return fmt.Errorf("failed to buffer response: %w", err)
+	}
+	if int64(len(data)) > max {
+		rsp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(data), rsp.Body), rsp.Body}
+		return nil
+	}
+
+	_ = rsp.Body.Close()
+	rsp.Body = io.NopCloser(bytes.NewReader(data))
+	rsp.ContentLength = int64(len(data))
+	rsp.TransferEncoding = nil
+	rsp.Header.Set("Content-Length", strconv.Itoa(len(data)))
+	return nil
+}
+
+func guardEventStream(rsp *http.Response) error {
+	if isEventStream(rsp.Header) {
+		rsp.Body = &eventStreamBody{ReadCloser: rsp.Body, ctx: rsp.Request.Context(), url: rsp.Request.URL.String()}
+	}
+	return nil
+}
+
+type eventStreamBody struct {
+	io.ReadCloser
+
+	ctx     context.Context
+	url     string
+	pending []byte
+	done    bool
+}
+
+func (b *eventStreamBody) Read(p []byte) (int, error) {
+	if b.done {
+		if len(b.pending) == 0 {
+			return 0, io.EOF
+		}
+		n := copy(p, b.pending)
+		b.pending = b.pending[n:]
+		return n, nil
+	}
+
+	n, err := b.ReadCloser.Read(p)
+	if err == nil || errors.Is(err, io.EOF) || b.ctx.Err() != nil {
+		return n, err
+	}
+
+	slog.Error("upstream stream terminated", "url", b.url, "error", err)
+	b.done = true
+	b.pending = sseErrorEvent("upstream stream terminated: " + err.Error())
+	return n, nil
+}
+
+var sseKeepalive = []byte(": keepalive\n\n")
+
+type readResult struct {
+	data []byte
+	err  error
+}
+
+type keepaliveBody struct {
+	body     io.ReadCloser
+	interval time.Duration
+
+	once    sync.Once
+	results chan readResult
+	closed  chan struct{}
+
+	pending []byte
+	err     error
+	tail    [2]byte
+}
+
+func newKeepaliveBody(body io.ReadCloser, interval time.Duration) *keepaliveBody {
+	return &keepaliveBody{
+		body:     body,
+		interval: interval,
+		results:  make(chan readResult),
+		closed:   make(chan struct{}),
+		tail:     [2]byte{'\n', '\n'},
+	}
+}
+
+func (b *keepaliveBody) pump() {
+	for {
+		buf := make([]byte, 32<<10)
+		n, err := b.body.Read(buf)
+		select {
+		case b.results <- readResult{data: buf[:n], err: err}:
+		case <-b.closed:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// atBoundary reports whether everything forwarded so far ends with a blank
+// line, so a comment can be injected without splitting an event.
+func (b *keepaliveBody) atBoundary() bool {
+	return b.tail == [2]byte{'\n', '\n'}
+}
+
+func (b *keepaliveBody) track(data []byte) {
+	for _, c := range data {
+		if c != '\r' {
+			b.tail[0], b.tail[1] = b.tail[1], c
+		}
+	}
+}
+
+func (b *keepaliveBody) Read(p []byte) (int, error) {
+	b.once.Do(func() { go b.pump() })
+
+	for len(b.pending) == 0 {
+		if b.err != nil {
+			return 0, b.err
+		}
+
+		timer := time.NewTimer(b.interval)
+		select {
+		case res := <-b.results:
+			timer.Stop()
+			b.track(res.data)
+			b.pending, b.err = res.data, res.err
+		case <-timer.C:
+			if b.atBoundary() {
+				return copy(p, sseKeepalive), nil
+			}
+		}
+	}
+
+	n := copy(p, b.pending)
+	b.pending = b.pending[n:]
+	return n, nil
+}
+
+func (b *keepaliveBody) Close() error {
+	select {
+	case <-b.closed:
+	default:
+		close(b.closed)
+	}
+	return b.body.Close()
+}
+
+func (ts *TokenSource) sampleAccessLog(status int) bool {
+	if status < 200 || status >= 300 || ts.AccessLogSample >= 1 {
+		return true
+	}
+	return rand.Float64() < ts.AccessLogSample
+}
+
+func isCompletionPath(path string) bool {
+	return strings.HasSuffix(strings.TrimSuffix(path, "/"), "/completions")
+}
+
+func readBody(r *http.Request) ([]byte, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, nil
+	}
+	data, err := io.ReadAll(r.Body)
+	_ = r.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read request body: %w", err)
+	}
+	r.Body = io.NopCloser(bytes.NewReader(data))
+	return data, nil
+}
+
+func isStreamRequest(body []byte) bool {
+	var payload struct {
+		Stream bool `json:"stream"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return false
+	}
+	return payload.Stream
+}
+
+func requestModel(body []byte) string {
+	var payload struct {
+		Model string `json:"model"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return ""
+	}
+	return payload.Model
+}
+
+// NewGitHubAPIProxy returns a handler proxying requests to the GitHub API
+// with the OAuth token.
+func (ts *TokenSource) NewGitHubAPIProxy(upstream *url.URL) http.Handler {
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(upstream)
+			r.Out.Header.Set("Authorization", "Bearer "+ts.oauthToken)
+			r.Out.Header.Set("User-Agent", "vscode-chat/dev")
+			r.Out.Header.Set("Accept", "application/json")
+		},
+		Transport: ts.transport,
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tracker := TrackStatusCode(w)
+		start := time.Now()
+
+		defer func() {
+			if !ts.sampleAccessLog(tracker.code) {
+				return
+			}
+			slog.Info("proxied request", "method", r.Method, "url", r.URL.String(), "ttfb", tracker.TTFB(start).String(), "duration", time.Since(start).String(), "bytes", tracker.bytes, "status", tracker.code, "name", "accesslog")
+		}()
+
+		proxy.ServeHTTP(tracker, r)
+	})
+}
+
+type StatusCodeTracker struct {
+	http.ResponseWriter
+
+	code     int
+	bytes    int64
+	writeErr error
+
+	firstWrite time.Time
+}
+
+func TrackStatusCode(w http.ResponseWriter) *StatusCodeTracker {
+	return &StatusCodeTracker{ResponseWriter: w, code: 0}
+}
+
+func (s *StatusCodeTracker) WriteHeader(code int) {
+	if s.code != 0 {
+		return
+	}
+	if s.firstWrite.IsZero() {
+		s.firstWrite = time.Now()
+	}
+	s.code = code
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *StatusCodeTracker) Write(b []byte) (int, error) {
+	if s.code == 0 {
+		s.code = http.StatusOK
+	}
+	if s.firstWrite.IsZero() {
+		s.firstWrite = time.Now()
+	}
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += int64(n)
+	if err != nil && s.writeErr == nil {
+		s.writeErr = err
+	}
+	return n, err
+}
+
+func (s *StatusCodeTracker) TTFB(start time.Time) time.Duration {
+	if s.firstWrite.IsZero() {
+		return 0
+	}
+	return s.firstWrite.Sub(start)
+}
+
+func (s *StatusCodeTracker) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+func (s *StatusCodeTracker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := s.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("%T does not support hijacking", s.ResponseWriter)
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err == nil && s.code == 0 {
+		s.code = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+func (s *StatusCodeTracker) ReadFrom(r io.Reader) (int64, error) {
+	from, ok := s.ResponseWriter.(io.ReaderFrom)
+	if !ok {
+		return io.Copy(struct{ io.Writer }{s}, r)
+	}
+	if s.code == 0 {
+		s.code = http.StatusOK
+	}
+	if s.firstWrite.IsZero() {
+		s.firstWrite = time.Now()
+	}
+	n, err := from.ReadFrom(r)
+	s.bytes += n
+	return n, err
+}
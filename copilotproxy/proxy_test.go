@@ -0,0 +1,119 @@
+package copilotproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNormalizePath(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"", "/"},
+		{"/", "/"},
+		{"chat/completions", "/chat/completions"},
+		{"/chat/completions", "/chat/completions"},
+		{"//chat//completions", "/chat/completions"},
+		{"/chat/completions/", "/chat/completions/"},
+		{"/chat/completions//", "/chat/completions/"},
+		{"/models/gpt-4o", "/models/gpt-4o"},
+	}
+	for _, tt := range tests {
+		if got := normalizePath(tt.in); got != tt.want {
+			t.Errorf("normalizePath(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestProxyRewritesURL(t *testing.T) {
+	var got *url.URL
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.URL
+	}))
+	defer upstream.Close()
+
+	ts := NewTokenSource("oauth")
+	ts.apiToken = APIToken{Token: "token", ExpiresAt: time.Now().Add(time.Hour).Unix()}
+	ts.obtainedAt = time.Now()
+
+	tests := []struct {
+		name     string
+		upstream string
+		target   string
+		path     string
+		query    string
+	}{
+		{"base path", "", "/api/v1/chat/completions", "/chat/completions", ""},
+		{"duplicate slashes", "", "/api/v1//chat//completions", "/chat/completions", ""},
+		{"trailing slash", "", "/api/v1/models/", "/models/", ""},
+		{"base path only", "", "/api/v1", "/", ""},
+		{"query string", "", "/api/v1/models?limit=10&order=desc", "/models", "limit=10&order=desc"},
+		{"encoded query", "", "/api/v1/models?q=a%2Fb+c", "/models", "q=a%2Fb+c"},
+		{"upstream path", "/copilot", "/api/v1/chat/completions", "/copilot/chat/completions", ""},
+		{"upstream path with slash", "/copilot/", "/api/v1//chat/completions?x=1", "/copilot/chat/completions", "x=1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target, err := url.Parse(upstream.URL + tt.upstream)
+			if err != nil {
+				t.Fatal(err)
+			}
+			handler := StripPrefix("/api/v1")(ts.NewProxy(target))
+			got = nil
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.target, nil))
+			if got == nil {
+				t.Fatalf("request did not reach the upstream: %d %s", w.Code, w.Body)
+			}
+			if got.Path != tt.path || got.RawQuery != tt.query {
+				t.Errorf("upstream got %q ? %q, want %q ? %q", got.Path, got.RawQuery, tt.path, tt.query)
+			}
+		})
+	}
+}
+
+func TestProxyErrors(t *testing.T) {
+	ts := NewTokenSource("oauth")
+	ts.apiToken = APIToken{Token: "token", ExpiresAt: time.Now().Add(time.Hour).Unix()}
+	ts.obtainedAt = time.Now()
+
+	t.Run("unreachable", func(t *testing.T) {
+		server := httptest.NewServer(http.NotFoundHandler())
+		target, _ := url.Parse(server.URL)
+		server.Close()
+
+		w := httptest.NewRecorder()
+		ts.NewProxy(target).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/models", nil))
+		if w.Code != http.StatusBadGateway || !strings.Contains(w.Body.String(), `"type":"upstream_error"`) {
+			t.Errorf("got %d %s, want a 502 upstream_error", w.Code, w.Body)
+		}
+	})
+
+	t.Run("stream cut off", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/event-stream")
+			_, _ = w.Write([]byte("data: {\"choices\":[]}\n\n"))
+			_ = http.NewResponseController(w).Flush()
+			conn, _, err := http.NewResponseController(w).Hijack()
+			if err == nil {
+				_ = conn.Close()
+			}
+		}))
+		defer server.Close()
+		target, _ := url.Parse(server.URL)
+
+		w := httptest.NewRecorder()
+		ts.NewProxy(target).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/models", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d, want the %d already sent", w.Code, http.StatusOK)
+		}
+		body := w.Body.String()
+		if !strings.HasPrefix(body, "data: {\"choices\":[]}\n\n") || !strings.Contains(body, "upstream stream terminated") {
+			t.Errorf("body = %q, want the first chunk followed by an error event", body)
+		}
+	})
+}
@@ -0,0 +1,316 @@
+package copilotproxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Quota is a token budget of an access token; 0 leaves a period unlimited.
+type Quota struct {
+	Daily   int64
+	Monthly int64
+}
+
+// ParseQuotas parses name:daily:monthly token quotas of access tokens.
+func ParseQuotas(values []string) (map[string]Quota, error) {
+	quotas := make(map[string]Quota, len(values))
+	for _, value := range values {
+		fields := strings.Split(value, ":")
+		if len(fields) != 3 || fields[0] == "" {
+			return nil, fmt.Errorf("invalid quota %q, expected name:daily:monthly", value)
+		}
+		daily, dailyErr := strconv.ParseInt(fields[1], 10, 64)
+		monthly, monthlyErr := strconv.ParseInt(fields[2], 10, 64)
+		if dailyErr != nil || monthlyErr != nil || daily < 0 || monthly < 0 {
+			return nil, fmt.Errorf("invalid quota %q, expected token counts >= 0", value)
+		}
+		if _, ok := quotas[fields[0]]; ok {
+			return nil, fmt.Errorf("duplicate quota for %q", fields[0])
+		}
+		quotas[fields[0]] = Quota{Daily: daily, Monthly: monthly}
+	}
+	return quotas, nil
+}
+
+// Quotas enforces token budgets per access token from the usage recorded
+// in a UsageStore. Days and months start at midnight local time. Requests
+// are checked against running totals kept in memory; the store is only
+// read to seed them and to answer /quota.
+//
+// The tokens of a request are only known once it completes, so each request
+// still in flight is counted as costing the average of the key's requests
+// completed so far. This keeps concurrent requests from overshooting a
+// budget together, though a single request may still take it over.
+type Quotas struct {
+	store    *UsageStore
+	defaults Quota
+	keys     map[string]Quota
+
+	mu        sync.Mutex
+	daily     periodUsage
+	monthly   periodUsage
+	inFlight  map[string]int64
+	completed map[string]completedUsage
+}
+
+// completedUsage is the tokens and number of the requests of a key
+// completed since Load.
+type completedUsage struct {
+	tokens   int64
+	requests int64
+}
+
+func (u completedUsage) average() int64 {
+	if u.requests == 0 {
+		return 0
+	}
+	return u.tokens / u.requests
+}
+
+// periodUsage is the tokens used by each key since start.
+type periodUsage struct {
+	start time.Time
+	used  map[string]int64
+}
+
+// NewQuotas returns the budgets of keys, and defaults for every other
+// access token.
+func NewQuotas(store *UsageStore, defaults Quota, keys map[string]Quota) *Quotas {
+	return &Quotas{store: store, defaults: defaults, keys: keys, inFlight: make(map[string]int64), completed: make(map[string]completedUsage)}
+}
+
+func (q *Quotas) Enabled() bool {
+	if q.defaults != (Quota{}) {
+		return true
+	}
+	for _, quota := range q.keys {
+		if quota != (Quota{}) {
+			return true
+		}
+	}
+	return false
+}
+
+func (q *Quotas) quotaFor(key string) Quota {
+	if quota, ok := q.keys[key]; ok {
+		return quota
+	}
+	return q.defaults
+}
+
+func dayStart(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+func monthStart(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+}
+
+// Load seeds the running totals from the usage recorded so far in the
+// current day and month, and keeps them up to date with every record from
+// then on. It must be called before serving.
+func (q *Quotas) Load(ctx context.Context) error {
+	now := time.Now()
+	daily, err := q.store.TokensByKeySince(ctx, dayStart(now))
+	if err != nil {
+		return err
+	}
+	monthly, err := q.store.TokensByKeySince(ctx, monthStart(now))
+	if err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	q.daily = periodUsage{start: dayStart(now), used: daily}
+	q.monthly = periodUsage{start: monthStart(now), used: monthly}
+	q.mu.Unlock()
+
+	q.store.Observe(q.add)
+	return nil
+}
+
+// roll starts new periods once now is past the current ones. q.mu must be
+// held.
+func (q *Quotas) roll(now time.Time) {
+	if day := dayStart(now); day.After(q.daily.start) {
+		q.daily = periodUsage{start: day, used: make(map[string]int64)}
+	}
+	if month := monthStart(now); month.After(q.monthly.start) {
+		q.monthly = periodUsage{start: month, used: make(map[string]int64)}
+	}
+}
+
+func (q *Quotas) add(rec UsageRecord) {
+	tokens := rec.PromptTokens + rec.CompletionTokens
+	if tokens <= 0 {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.roll(time.Now())
+	if q.daily.used == nil {
+		q.daily.used = make(map[string]int64)
+	}
+	if q.monthly.used == nil {
+		q.monthly.used = make(map[string]int64)
+	}
+	// Like the store, a request counts for the period it started in.
+	if !rec.Time.Before(q.daily.start) {
+		q.daily.used[rec.Key] += tokens
+	}
+	if !rec.Time.Before(q.monthly.start) {
+		q.monthly.used[rec.Key] += tokens
+	}
+	completed := q.completed[rec.Key]
+	completed.tokens += tokens
+	completed.requests++
+	q.completed[rec.Key] = completed
+}
+
+type quotaStatus struct {
+	Period    string    `json:"period"`
+	Limit     int64     `json:"limit"`
+	Used      int64     `json:"used"`
+	Remaining int64     `json:"remaining"`
+	ResetsAt  time.Time `json:"resets_at"`
+}
+
+type quotaPeriod struct {
+	name          string
+	limit         int64
+	start, resets time.Time
+}
+
+// periods returns the limited periods of key that now falls in.
+func (q *Quotas) periods(key string, now time.Time) []quotaPeriod {
+	quota := q.quotaFor(key)
+	day, month := dayStart(now), monthStart(now)
+	var periods []quotaPeriod
+	if quota.Daily > 0 {
+		periods = append(periods, quotaPeriod{"daily", quota.Daily, day, day.AddDate(0, 0, 1)})
+	}
+	if quota.Monthly > 0 {
+		periods = append(periods, quotaPeriod{"monthly", quota.Monthly, month, month.AddDate(0, 1, 0)})
+	}
+	return periods
+}
+
+func newQuotaStatus(period quotaPeriod, used int64) quotaStatus {
+	return quotaStatus{
+		Period:    period.name,
+		Limit:     period.limit,
+		Used:      used,
+		Remaining: max(period.limit-used, 0),
+		ResetsAt:  period.resets.UTC(),
+	}
+}
+
+// Status returns the limited periods of key with the tokens used so far,
+// as recorded in the store.
+func (q *Quotas) Status(ctx context.Context, key string, now time.Time) ([]quotaStatus, error) {
+	var statuses []quotaStatus
+	for _, period := range q.periods(key, now) {
+		used, err := q.store.TokensSince(ctx, key, period.start)
+		if err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, newQuotaStatus(period, used))
+	}
+	return statuses, nil
+}
+
+// reserve returns the first period of key whose budget is used up by the
+// running totals and the requests of key in flight. Otherwise it counts one
+// more request in flight, until release.
+func (q *Quotas) reserve(key string, now time.Time) (quotaStatus, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.roll(now)
+	reserved := q.inFlight[key] * q.completed[key].average()
+	for _, period := range q.periods(key, now) {
+		used := q.daily.used[key]
+		if period.name == "monthly" {
+			used = q.monthly.used[key]
+		}
+		if used+reserved >= period.limit {
+			return newQuotaStatus(period, used), true
+		}
+	}
+	q.inFlight[key]++
+	return quotaStatus{}, false
+}
+
+func (q *Quotas) release(key string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.inFlight[key]--; q.inFlight[key] <= 0 {
+		delete(q.inFlight, key)
+	}
+}
+
+// EnforceQuotas rejects requests of an access token that has used up one of
+// its budgets with an OpenAI insufficient_quota error.
+func EnforceQuotas(quotas *Quotas) Middleware {
+	return func(next http.Handler) http.Handler {
+		if quotas == nil || !quotas.Enabled() {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r, info := withRequestInfo(r)
+			if info.quotaReserved {
+				next.ServeHTTP(w, r)
+				return
+			}
+			now := time.Now()
+			if status, ok := quotas.reserve(info.key, now); ok {
+				quotaExceeded.Inc(keyLabel(info.key), status.Period)
+				w.Header().Set("Retry-After", strconv.Itoa(int(status.ResetsAt.Sub(now).Seconds())+1))
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("X-Content-Type-Options", "nosniff")
+				w.WriteHeader(http.StatusTooManyRequests)
+				_ = json.NewEncoder(w).Encode(openAIError{Error: openAIErrorBody{
+					Message: fmt.Sprintf("%s token quota of %d exceeded, it resets at %s", status.Period, status.Limit, status.ResetsAt.Format(time.RFC3339)),
+					Type:    "insufficient_quota",
+					Code:    "insufficient_quota",
+				}})
+				return
+			}
+			// The usage of the request has been added to the running totals
+			// by the time it returns.
+			info.quotaReserved = true
+			defer quotas.release(info.key)
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// QuotaHandler reports the budgets of the access token of the request and
+// how much of them is left.
+func QuotaHandler(quotas *Quotas) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := requestInfoFrom(r.Context()).key
+		statuses, err := quotas.Status(r.Context(), key, time.Now())
+		if err != nil {
+			slog.Error("failed to read token quota usage", "key", key, "error", err)
+			writeOpenAIError(w, http.StatusInternalServerError, "server_error", "failed to read token usage")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"key":    key,
+			"quotas": append([]quotaStatus{}, statuses...),
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package copilotproxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEnforceQuotasRunningTotals(t *testing.T) {
+	store, err := OpenUsageStore(filepath.Join(t.TempDir(), "usage.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if err := store.insert([]UsageRecord{
+		{Time: time.Now(), Key: "alice", PromptTokens: 60, CompletionTokens: 30},
+		{Time: monthStart(time.Now()), Key: "bob", PromptTokens: 500},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	quotas := NewQuotas(store, Quota{Daily: 100}, map[string]Quota{"bob": {Monthly: 1000}})
+	if err := quotas.Load(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	handler := EnforceQuotas(quotas)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	status := func(key string) int {
+		r := httptest.NewRequest(http.MethodPost, "/chat/completions", nil)
+		r, info := withRequestInfo(r)
+		info.key = key
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	if got := status("alice"); got != http.StatusOK {
+		t.Fatalf("alice at 90 of 100: status = %d, want %d", got, http.StatusOK)
+	}
+	store.Record(UsageRecord{Time: time.Now(), Key: "alice", CompletionTokens: 10})
+	if got := status("alice"); got != http.StatusTooManyRequests {
+		t.Fatalf("alice at 100 of 100: status = %d, want %d", got, http.StatusTooManyRequests)
+	}
+
+	// The monthly budget includes the usage seeded from the store.
+	store.Record(UsageRecord{Time: time.Now(), Key: "bob", PromptTokens: 499})
+	if got := status("bob"); got != http.StatusOK {
+		t.Fatalf("bob at 999 of 1000: status = %d, want %d", got, http.StatusOK)
+	}
+	store.Record(UsageRecord{Time: time.Now(), Key: "bob", PromptTokens: 1})
+	if got := status("bob"); got != http.StatusTooManyRequests {
+		t.Fatalf("bob at 1000 of 1000: status = %d, want %d", got, http.StatusTooManyRequests)
+	}
+}
+
+func TestEnforceQuotasReservesInFlight(t *testing.T) {
+	store, err := OpenUsageStore(filepath.Join(t.TempDir(), "usage.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	quotas := NewQuotas(store, Quota{Daily: 100}, nil)
+	if err := quotas.Load(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	store.Record(UsageRecord{Time: time.Now(), Key: "alice", PromptTokens: 30, CompletionTokens: 10})
+
+	// At 40 of 100 with 40 tokens per request, two requests fit in flight.
+	now := time.Now()
+	for i, want := range []bool{false, false, true} {
+		if _, exceeded := quotas.reserve("alice", now); exceeded != want {
+			t.Fatalf("request %d in flight: exceeded = %v, want %v", i+1, exceeded, want)
+		}
+	}
+	quotas.release("alice")
+	if _, exceeded := quotas.reserve("alice", now); exceeded {
+		t.Fatal("request after a release: exceeded")
+	}
+	quotas.release("alice")
+	quotas.release("alice")
+
+	// A translated request passing EnforceQuotas twice is reserved once,
+	// and released when it is done.
+	var inFlight int64
+	inner := EnforceQuotas(quotas)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inFlight = quotas.inFlight["alice"]
+	}))
+	r := httptest.NewRequest(http.MethodPost, "/chat/completions", nil)
+	r, info := withRequestInfo(r)
+	info.key = "alice"
+	w := httptest.NewRecorder()
+	EnforceQuotas(quotas)(inner).ServeHTTP(w, r)
+	if w.Code != http.StatusOK || inFlight != 1 {
+		t.Errorf("nested EnforceQuotas: status = %d with %d requests in flight, want %d with 1", w.Code, inFlight, http.StatusOK)
+	}
+	if n := len(quotas.inFlight); n != 0 {
+		t.Errorf("%d keys still have requests in flight", n)
+	}
+}
@@ -0,0 +1,139 @@
+package copilotproxy
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type tokenBucket struct {
+	level   float64
+	updated time.Time
+}
+
+// refill adds what has accumulated since the last call, up to capacity,
+// at capacity per minute.
+func (b *tokenBucket) refill(now time.Time, capacity float64) {
+	if b.updated.IsZero() {
+		b.level = capacity
+	} else {
+		b.level = math.Min(capacity, b.level+now.Sub(b.updated).Minutes()*capacity)
+	}
+	b.updated = now
+}
+
+// wait returns how long until the bucket holds at least want.
+func (b *tokenBucket) wait(want, capacity float64) time.Duration {
+	if b.level >= want {
+		return 0
+	}
+	return time.Duration((want - b.level) / capacity * float64(time.Minute))
+}
+
+type keyBuckets struct {
+	requests tokenBucket
+	tokens   tokenBucket
+}
+
+// KeyRateLimiter limits the requests and tokens per minute of each access
+// token with token buckets. Tokens are only known once a response is done,
+// so they are charged afterwards and a key is held back until its bucket
+// has refilled.
+type KeyRateLimiter struct {
+	mu       sync.Mutex
+	requests float64
+	tokens   float64
+	buckets  map[string]*keyBuckets
+}
+
+// NewKeyRateLimiter returns a limiter for requestsPerMinute and
+// tokensPerMinute per key; 0 leaves that limit off.
+func NewKeyRateLimiter(requestsPerMinute, tokensPerMinute int) *KeyRateLimiter {
+	return &KeyRateLimiter{
+		requests: float64(requestsPerMinute),
+		tokens:   float64(tokensPerMinute),
+		buckets:  make(map[string]*keyBuckets),
+	}
+}
+
+func (l *KeyRateLimiter) bucketsFor(key string, now time.Time) *keyBuckets {
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &keyBuckets{}
+		l.buckets[key] = b
+	}
+	if l.requests > 0 {
+		b.requests.refill(now, l.requests)
+	}
+	if l.tokens > 0 {
+		b.tokens.refill(now, l.tokens)
+	}
+	return b
+}
+
+// Allow takes a request from the bucket of key. Otherwise it reports which
+// limit was hit and when to retry.
+func (l *KeyRateLimiter) Allow(key string) (limit string, retryAfter time.Duration, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b := l.bucketsFor(key, time.Now())
+	if l.tokens > 0 && b.tokens.level <= 0 {
+		return "tokens", b.tokens.wait(0, l.tokens), false
+	}
+	if l.requests > 0 {
+		if b.requests.level < 1 {
+			return "requests", b.requests.wait(1, l.requests), false
+		}
+		b.requests.level--
+	}
+	return "", 0, true
+}
+
+// Charge takes the tokens used by a request of key from its bucket.
+func (l *KeyRateLimiter) Charge(key string, tokens int64) {
+	if l.tokens <= 0 || tokens <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.bucketsFor(key, time.Now()).tokens.level -= float64(tokens)
+}
+
+// CountsTokens reports whether the limiter needs the token counts of
+// responses.
+func (l *KeyRateLimiter) CountsTokens() bool {
+	return l != nil && l.tokens > 0
+}
+
+// LimitKeys rejects requests of an access token over its rate limit with a
+// 429 and Retry-After. Token counts come from the usage middleware, which
+// must run inside this one.
+func LimitKeys(limiter *KeyRateLimiter) Middleware {
+	return func(next http.Handler) http.Handler {
+		if limiter == nil || (limiter.requests <= 0 && limiter.tokens <= 0) {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r, info := withRequestInfo(r)
+			limit, retryAfter, ok := limiter.Allow(info.key)
+			if !ok {
+				max := limiter.requests
+				if limit == "tokens" {
+					max = limiter.tokens
+				}
+				keyRateLimited.Inc(keyLabel(info.key), limit)
+				w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+				writeOpenAIError(w, http.StatusTooManyRequests, "rate_limit_error", fmt.Sprintf("rate limit of %g %s per minute reached", max, limit))
+				return
+			}
+
+			next.ServeHTTP(w, r)
+			limiter.Charge(info.key, info.promptTokens+info.completionTokens)
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package copilotproxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type cachedToken struct {
+	APIToken
+	ObtainedAt time.Time `json:"obtained_at"`
+}
+
+// cacheFile returns the file the API token is persisted to. It is named
+// after a hash of the OAuth token so that accounts never share a file.
+func (ts *TokenSource) cacheFile() string {
+	if ts.CacheDir == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(ts.oauthToken))
+	return filepath.Join(ts.CacheDir, "token-"+hex.EncodeToString(sum[:8])+".json")
+}
+
+// LoadCachedToken restores the API token persisted in CacheDir by an earlier
+// run. It reports whether a token was loaded; a missing file or a token
+// that is no longer usable is not an error.
+func (ts *TokenSource) LoadCachedToken() (bool, error) {
+	file := ts.cacheFile()
+	if file == "" {
+		return false, nil
+	}
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to read token cache: %w", err)
+	}
+	var cached cachedToken
+	if err := json.Unmarshal(data, &cached); err != nil {
+		return false, fmt.Errorf("failed to parse token cache %s: %w", file, err)
+	}
+	if cached.Token == "" {
+		return false, nil
+	}
+
+	ts.mu.Lock()
+	previous, previousObtainedAt := ts.apiToken, ts.obtainedAt
+	ts.apiToken = cached.APIToken
+	ts.obtainedAt = cached.ObtainedAt
+	ts.refreshAt = cached.ObtainedAt.Add(ts.refreshDelay(cached.RefreshIn))
+	usable := ts.ready()
+	if !usable {
+		ts.apiToken, ts.obtainedAt, ts.refreshAt = previous, previousObtainedAt, time.Time{}
+	}
+	ts.mu.Unlock()
+
+	if !usable {
+		slog.Info("ignoring expired cached token", "file", file, "expires_at", time.Unix(cached.ExpiresAt, 0))
+		return false, nil
+	}
+	slog.Info("loaded cached token", "file", file, "expires_at", time.Unix(cached.ExpiresAt, 0))
+	ts.observeReadiness()
+	return true, nil
+}
+
+func (ts *TokenSource) saveCachedToken(apiToken APIToken, obtainedAt time.Time) {
+	file := ts.cacheFile()
+	if file == "" {
+		return
+	}
+	if err := writeCachedToken(file, cachedToken{APIToken: apiToken, ObtainedAt: obtainedAt}); err != nil {
+		slog.Warn("failed to persist token", "file", file, "error", err)
+	}
+}
+
+func writeCachedToken(file string, cached cachedToken) error {
+	data, err := json.Marshal(cached)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0o700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(file), ".token-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
@@ -0,0 +1,639 @@
+package copilotproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+)
+
+const (
+	OAuthTokenEndpoint = "https://api.github.com/copilot_internal/v2/token"
+	APIEndpoint        = "https://api.githubcopilot.com"
+	GitHubAPIEndpoint  = "https://api.github.com"
+)
+
+// APIToken is the response of the Copilot token endpoint.
+type APIToken struct {
+	ExpiresAt int64  `json:"expires_at"`
+	RefreshIn int64  `json:"refresh_in"`
+	Token     string `json:"token"`
+}
+
+// TokenSource keeps a valid Copilot API token for an OAuth token.
+type TokenSource struct {
+	mu         sync.RWMutex
+	apiToken   APIToken
+	refreshAt  time.Time
+	obtainedAt time.Time
+	oauthToken string
+
+	next           *APIToken
+	nextObtainedAt time.Time
+
+	TokenEndpoint  string
+	RefreshLead    time.Duration
+	RefreshTimeout time.Duration
+	StartupJitter  time.Duration
+	ExpiryGrace    time.Duration
+	MaxTokenAge    time.Duration
+	PrefetchLead   time.Duration
+	CacheDir       string
+
+	StopOnAuthError bool
+
+	OnRefreshError    func(err error, failures int)
+	OnRefreshSuccess  func()
+	OnReadinessChange func(ready bool)
+
+	AuthScheme   string
+	UserAgent    string
+	Accept       string
+	ExtraHeaders http.Header
+
+	IntegrationID         string
+	AllowedIntegrationIDs []string
+	AllowedUpstreams      []*url.URL
+	DefaultModel          string
+
+	BufferResponseBytes  int64
+	SlowRequestThreshold time.Duration
+	SSEKeepalive         time.Duration
+
+	ResponseHooks   []func(*http.Response) error
+	AccessLogSample float64
+	Retry           RetryPolicy
+
+	client    *http.Client
+	transport http.RoundTripper
+	now       func() time.Time
+
+	rejectMu sync.Mutex
+
+	readyState    atomic.Bool
+	degradedState atomic.Bool
+	heartbeat     atomic.Int64
+	refreshed     chan APIToken
+}
+
+// NewTokenSource returns a TokenSource with default settings. Call Start to
+// begin fetching tokens.
+func NewTokenSource(oauthToken string) *TokenSource {
+	return &TokenSource{
+		oauthToken: oauthToken,
+
+		TokenEndpoint:  OAuthTokenEndpoint,
+		RefreshLead:    10 * time.Second,
+		RefreshTimeout: 10 * time.Second,
+
+		AuthScheme:   "Bearer",
+		UserAgent:    "vscode-chat/dev",
+		Accept:       "application/json",
+		ExtraHeaders: make(http.Header),
+
+		IntegrationID: "vscode-chat",
+
+		AccessLogSample: 1,
+
+		client:    http.DefaultClient,
+		refreshed: make(chan APIToken, 1),
+	}
+}
+
+// WithOAuthToken returns a new TokenSource for oauthToken with the same
+// settings, hooks and transport as ts.
+func (ts *TokenSource) WithOAuthToken(oauthToken string) *TokenSource {
+	clone := NewTokenSource(oauthToken)
+	clone.TokenEndpoint = ts.TokenEndpoint
+	clone.RefreshLead = ts.RefreshLead
+	clone.RefreshTimeout = ts.RefreshTimeout
+	clone.StartupJitter = ts.StartupJitter
+	clone.ExpiryGrace = ts.ExpiryGrace
+	clone.MaxTokenAge = ts.MaxTokenAge
+	clone.PrefetchLead = ts.PrefetchLead
+	clone.CacheDir = ts.CacheDir
+	clone.StopOnAuthError = ts.StopOnAuthError
+	clone.OnRefreshError = ts.OnRefreshError
+	clone.OnRefreshSuccess = ts.OnRefreshSuccess
+	clone.OnReadinessChange = ts.OnReadinessChange
+	clone.AuthScheme = ts.AuthScheme
+	clone.UserAgent = ts.UserAgent
+	clone.Accept = ts.Accept
+	clone.ExtraHeaders = ts.ExtraHeaders.Clone()
+	clone.IntegrationID = ts.IntegrationID
+	clone.AllowedIntegrationIDs = ts.AllowedIntegrationIDs
+	clone.AllowedUpstreams = ts.AllowedUpstreams
+	clone.DefaultModel = ts.DefaultModel
+	clone.BufferResponseBytes = ts.BufferResponseBytes
+	clone.SlowRequestThreshold = ts.SlowRequestThreshold
+	clone.SSEKeepalive = ts.SSEKeepalive
+	clone.ResponseHooks = ts.ResponseHooks
+	clone.AccessLogSample = ts.AccessLogSample
+	clone.Retry = ts.Retry
+	clone.client = ts.client
+	clone.transport = ts.transport
+	return clone
+}
+
+// SetTransport sets the transport used for token refreshes and, via NewProxy,
+// for proxied requests.
+func (ts *TokenSource) SetTransport(transport http.RoundTripper) {
+	ts.client = &http.Client{Transport: transport}
+	ts.transport = transport
+}
+
+// Client returns the HTTP client used for token refreshes.
+func (ts *TokenSource) Client() *http.Client {
+	return ts.client
+}
+
+const (
+	refreshTickInterval     = 10 * time.Second
+	refreshRetryInterval    = 5 * time.Second
+	maxRefreshRetryInterval = 5 * time.Minute
+	authRetryInterval       = 10 * time.Minute
+)
+
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return max(time.Until(at), 0)
+	}
+	return 0
+}
+
+func retryDelay(err error, failures int) time.Duration {
+	var refreshErr *RefreshError
+	if errors.As(err, &refreshErr) {
+		if refreshErr.Kind == RefreshErrorAuth {
+			return authRetryInterval
+		}
+		if refreshErr.RetryAfter > 0 {
+			return refreshErr.RetryAfter
+		}
+	}
+	return min(refreshRetryInterval<<min(failures-1, 10), maxRefreshRetryInterval)
+}
+
+func (ts *TokenSource) refreshDelay(refreshIn int64) time.Duration {
+	delay := time.Duration(refreshIn)*time.Second - ts.RefreshLead
+	if ts.MaxTokenAge > 0 {
+		delay = min(delay, ts.MaxTokenAge-ts.RefreshLead)
+	}
+	if delay <= 0 {
+		return refreshTickInterval
+	}
+	return max(delay, refreshTickInterval)
+}
+
+// Start refreshes the token in the background until ctx is done. It only
+// returns an error if StopOnAuthError is set and GitHub rejects the OAuth
+// token.
+func (ts *TokenSource) Start(ctx context.Context) error {
+	if ts.StartupJitter > 0 && !ts.Ready() {
+		delay := rand.N(ts.StartupJitter)
+		slog.Info("delaying initial token refresh", "delay", delay)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(delay):
+		}
+	}
+
+	var timeout <-chan time.Time
+	var retry <-chan time.Time
+	var retryAt time.Time
+	failures := 0
+
+	ticker := time.NewTicker(refreshTickInterval)
+	defer ticker.Stop()
+
+	first := make(chan struct{})
+	close(first)
+
+	for {
+		ts.heartbeat.Store(time.Now().UnixNano())
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-timeout:
+			timeout = nil
+		case <-retry:
+			retry = nil
+		case <-first:
+			first = nil
+		case <-ticker.C:
+		case <-ts.refreshed:
+			failures, retryAt, retry = 0, time.Time{}, nil
+			timeout = time.After(ts.untilNextRefresh())
+			continue
+		}
+
+		if ts.promoteNext() {
+			timeout = time.After(ts.untilNextRefresh())
+		}
+		prefetch := false
+		if ts.observeReadiness() && !ts.refreshDue() {
+			if !ts.prefetchDue() {
+				continue
+			}
+			prefetch = true
+		}
+		if time.Now().Before(retryAt) {
+			continue
+		}
+
+		var apiToken APIToken
+		start := time.Now()
+		if err := ts.refresh(ctx, &apiToken); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			failures++
+			delay := retryDelay(err, failures)
+			if ts.OnRefreshError != nil {
+				ts.OnRefreshError(err, failures)
+			}
+			if RefreshErrorKindOf(err) == RefreshErrorAuth {
+				if ts.StopOnAuthError {
+					return err
+				}
+				slog.Error("OAuth token rejected by GitHub, retrying slowly", "error", err, "retry", delay)
+			} else {
+				slog.Error("failed to refresh token", "error", err, "kind", RefreshErrorKindOf(err).String(), "attempt", failures, "retry", delay)
+			}
+			retryAt = time.Now().Add(delay)
+			retry = time.After(delay)
+			continue
+		}
+		failures = 0
+		retryAt = time.Time{}
+		if prefetch {
+			ts.stageAPIToken(apiToken, time.Since(start))
+		} else {
+			ts.setAPIToken(apiToken, time.Since(start))
+		}
+
+		timeout = time.After(ts.untilNextRefresh())
+	}
+}
+
+// RefreshLoopStalled reports whether Start is running but its loop has not
+// come around for several tick intervals. It is false if Start was never
+// called.
+func (ts *TokenSource) RefreshLoopStalled() bool {
+	last := ts.heartbeat.Load()
+	if last == 0 {
+		return false
+	}
+	return time.Since(time.Unix(0, last)) > 3*refreshTickInterval+ts.RefreshTimeout
+}
+
+// RefreshNow fetches a new token immediately.
+func (ts *TokenSource) RefreshNow(ctx context.Context) error {
+	var apiToken APIToken
+	start := time.Now()
+	if err := ts.refresh(ctx, &apiToken); err != nil {
+		return err
+	}
+	ts.setAPIToken(apiToken, time.Since(start))
+
+	for {
+		select {
+		case ts.refreshed <- apiToken:
+			return nil
+		default:
+		}
+		select {
+		case <-ts.refreshed:
+		default:
+		}
+	}
+}
+
+// minRejectedRefreshInterval is how old a token rejected by the upstream
+// must be before it is refreshed, so that an upstream rejecting every token
+// does not turn each request into a token exchange.
+const minRejectedRefreshInterval = 30 * time.Second
+
+var errRejectedTooSoon = errors.New("token was refreshed too recently")
+
+// refreshRejected fetches a new token after the upstream rejected the
+// given one. Requests rejected together share one refresh: if the token has
+// changed since, there is nothing to do.
+func (ts *TokenSource) refreshRejected(ctx context.Context, rejected string) error {
+	ts.rejectMu.Lock()
+	defer ts.rejectMu.Unlock()
+
+	ts.mu.RLock()
+	current, obtainedAt := ts.apiToken.Token, ts.obtainedAt
+	ts.mu.RUnlock()
+	if current != rejected {
+		return nil
+	}
+	if time.Since(obtainedAt) < minRejectedRefreshInterval {
+		return errRejectedTooSoon
+	}
+	return ts.RefreshNow(ctx)
+}
+
+func (ts *TokenSource) setAPIToken(apiToken APIToken, duration time.Duration) {
+	slog.Info("token refreshed", "expires_at", time.Unix(apiToken.ExpiresAt, 0), "refresh_in", time.Duration(apiToken.RefreshIn)*time.Second, "duration", duration)
+
+	ts.mu.Lock()
+	ts.apiToken = apiToken
+	ts.obtainedAt = ts.clock()
+	ts.refreshAt = ts.obtainedAt.Add(ts.refreshDelay(apiToken.RefreshIn))
+	ts.next = nil
+	obtainedAt := ts.obtainedAt
+	ts.mu.Unlock()
+
+	ts.saveCachedToken(apiToken, obtainedAt)
+
+	if ts.OnRefreshSuccess != nil {
+		ts.OnRefreshSuccess()
+	}
+	ts.observeReadiness()
+}
+
+// stageAPIToken keeps a prefetched token to be promoted by promoteNext once
+// the current one is due for refresh.
+func (ts *TokenSource) stageAPIToken(apiToken APIToken, duration time.Duration) {
+	slog.Info("next token prefetched", "expires_at", time.Unix(apiToken.ExpiresAt, 0), "refresh_in", time.Duration(apiToken.RefreshIn)*time.Second, "duration", duration)
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	ts.next = &apiToken
+	ts.nextObtainedAt = ts.clock()
+}
+
+// promoteNext replaces the current token with the staged one when the
+// current token is due for refresh. A staged token that is no longer valid
+// is dropped so that the next tick fetches a fresh one.
+func (ts *TokenSource) promoteNext() bool {
+	ts.mu.Lock()
+	if ts.next == nil || ts.clock().Before(ts.refreshAt) {
+		ts.mu.Unlock()
+		return false
+	}
+	next, obtainedAt := *ts.next, ts.nextObtainedAt
+	ts.next = nil
+	if !ts.clock().Add(ts.RefreshLead).Before(time.Unix(next.ExpiresAt, 0)) {
+		ts.mu.Unlock()
+		slog.Warn("dropping expired prefetched token", "expires_at", time.Unix(next.ExpiresAt, 0))
+		return false
+	}
+	ts.apiToken = next
+	ts.obtainedAt = obtainedAt
+	ts.refreshAt = obtainedAt.Add(ts.refreshDelay(next.RefreshIn))
+	refreshAt := ts.refreshAt
+	ts.mu.Unlock()
+
+	slog.Info("promoted prefetched token", "expires_at", time.Unix(next.ExpiresAt, 0), "refresh_at", refreshAt)
+	ts.saveCachedToken(next, obtainedAt)
+	if ts.OnRefreshSuccess != nil {
+		ts.OnRefreshSuccess()
+	}
+	ts.observeReadiness()
+	return true
+}
+
+func (ts *TokenSource) prefetchDue() bool {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	return ts.PrefetchLead > 0 && ts.next == nil && !ts.clock().Before(ts.refreshAt.Add(-ts.PrefetchLead))
+}
+
+// untilNextRefresh returns how long until the token is due for refresh, or
+// until the next token should be prefetched.
+func (ts *TokenSource) untilNextRefresh() time.Duration {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	at := ts.refreshAt
+	if ts.PrefetchLead > 0 && ts.next == nil {
+		at = at.Add(-ts.PrefetchLead)
+	}
+	return max(at.Sub(ts.clock()), 0)
+}
+
+func (ts *TokenSource) refreshDue() bool {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	return !ts.clock().Before(ts.refreshAt)
+}
+
+func (ts *TokenSource) observeReadiness() bool {
+	ready := ts.Ready()
+	if ts.readyState.Swap(ready) != ready {
+		if ready {
+			slog.Info("became ready")
+		} else {
+			slog.Warn("became not ready")
+		}
+		if ts.OnReadinessChange != nil {
+			ts.OnReadinessChange(ready)
+		}
+	}
+	degraded := ts.Degraded()
+	if ts.degradedState.Swap(degraded) != degraded && degraded {
+		slog.Warn("token expired, serving within grace period", "expires_at", ts.ExpiresAt(), "grace", ts.ExpiryGrace)
+	}
+	return ready
+}
+
+type RefreshErrorKind int
+
+const (
+	RefreshErrorTransient RefreshErrorKind = iota
+	RefreshErrorAuth
+	RefreshErrorParse
+)
+
+func (k RefreshErrorKind) String() string {
+	switch k {
+	case RefreshErrorAuth:
+		return "auth"
+	case RefreshErrorParse:
+		return "parse"
+	default:
+		return "transient"
+	}
+}
+
+// RefreshError is returned when a token refresh fails.
+type RefreshError struct {
+	Kind       RefreshErrorKind
+	StatusCode int
+	Body       string
+	RetryAfter time.Duration
+	Err        error
+}
+
+func (e *RefreshError) Error() string {
+	msg := "failed to refresh token"
+	if e.Kind == RefreshErrorAuth {
+		msg = "OAuth token rejected by GitHub"
+	}
+	if e.StatusCode != 0 {
+		msg += fmt.Sprintf(": status: %d, body: %s", e.StatusCode, e.Body)
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *RefreshError) Unwrap() error {
+	return e.Err
+}
+
+// RefreshErrorKindOf returns the kind of a refresh error, treating errors
+// that are not a *RefreshError as transient.
+func RefreshErrorKindOf(err error) RefreshErrorKind {
+	var refreshErr *RefreshError
+	if errors.As(err, &refreshErr) {
+		return refreshErr.Kind
+	}
+	return RefreshErrorTransient
+}
+
+func (ts *TokenSource) refresh(ctx context.Context, apiToken *APIToken) (err error) {
+	if ts.RefreshTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, ts.RefreshTimeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	ctx, span := otel.Tracer(tracerName).Start(ctx, "TokenSource.refresh")
+	defer func() {
+		outcome := "success"
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			outcome = "error"
+		}
+		tokenRefreshes.Inc(outcome)
+		tokenRefreshDuration.Observe(time.Since(start).Seconds(), outcome)
+		span.End()
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ts.TokenEndpoint, nil)
+	if err != nil {
+		return &RefreshError{Kind: RefreshErrorTransient, Err: fmt.Errorf("failed to create request: %w", err)}
+	}
+	req.Header.Set("Authorization", ts.AuthScheme+" "+ts.oauthToken)
+	req.Header.Set("User-Agent", ts.UserAgent)
+	req.Header.Set("Accept", ts.Accept)
+	for key, values := range ts.ExtraHeaders {
+		req.Header[key] = values
+	}
+
+	rsp, err := ts.client.Do(req)
+	if err != nil {
+		return &RefreshError{Kind: RefreshErrorTransient, Err: err}
+	}
+	defer rsp.Body.Close()
+
+	data, err := io.ReadAll(rsp.Body)
+	if err != nil {
+		return &RefreshError{Kind: RefreshErrorTransient, StatusCode: rsp.StatusCode, Err: fmt.Errorf("failed to read response: %w", err)}
+	}
+
+	switch rsp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return &RefreshError{Kind: RefreshErrorAuth, StatusCode: rsp.StatusCode, Body: string(data)}
+	default:
+		return &RefreshError{Kind: RefreshErrorTransient, StatusCode: rsp.StatusCode, Body: string(data), RetryAfter: parseRetryAfter(rsp.Header.Get("Retry-After"))}
+	}
+
+	if err = json.Unmarshal(data, apiToken); err != nil {
+		return &RefreshError{Kind: RefreshErrorParse, StatusCode: rsp.StatusCode, Body: string(data), Err: fmt.Errorf("failed to unmarshal token: %w", err)}
+	}
+	if apiToken.Token == "" {
+		return &RefreshError{Kind: RefreshErrorParse, StatusCode: rsp.StatusCode, Err: errors.New("response has no token")}
+	}
+
+	return nil
+}
+
+// clock returns the current time, which tests may fake.
+func (ts *TokenSource) clock() time.Time {
+	if ts.now != nil {
+		return ts.now()
+	}
+	return time.Now()
+}
+
+// Ready reports whether the current token can be used.
+func (ts *TokenSource) Ready() bool {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	return ts.ready()
+}
+
+func (ts *TokenSource) ready() bool {
+	if ts.MaxTokenAge > 0 && ts.clock().Sub(ts.obtainedAt) > ts.MaxTokenAge {
+		return false
+	}
+	expiresAt := time.Unix(ts.apiToken.ExpiresAt, 0)
+	if ts.ExpiryGrace > 0 {
+		return ts.clock().Before(expiresAt.Add(ts.ExpiryGrace))
+	}
+	return ts.clock().Add(ts.RefreshLead).Before(expiresAt)
+}
+
+func (ts *TokenSource) Degraded() bool {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	return ts.ready() && !time.Now().Add(ts.RefreshLead).Before(time.Unix(ts.apiToken.ExpiresAt, 0))
+}
+
+func (ts *TokenSource) ExpiresAt() time.Time {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	return time.Unix(ts.apiToken.ExpiresAt, 0)
+}
+
+// Token returns the current Copilot API token.
+func (ts *TokenSource) Token() string {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	return ts.apiToken.Token
+}
+
+// CustomHeaders sets the authorization and editor headers the Copilot API
+// expects.
+func (ts *TokenSource) CustomHeaders(header http.Header) {
+	header.Set("Authorization", "Bearer "+ts.Token())
+	header.Set("User-Agent", "vscode-chat/dev")
+	header.Set("Copilot-Integration-Id", ts.IntegrationID)
+	header.Set("Editor-Version", "Neovim/0.11.0")
+	header.Set("Editor-Plugin-Version", "copilot-chat/0.1.0")
+}
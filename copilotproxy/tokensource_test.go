@@ -0,0 +1,195 @@
+package copilotproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// tokenServer answers token refreshes with a token expiring in an hour
+// and the given refresh_in, counting the refreshes.
+func tokenServer(t *testing.T, refreshIn int64) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var refreshes atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		refreshes.Add(1)
+		_ = json.NewEncoder(w).Encode(APIToken{Token: "token", ExpiresAt: time.Now().Add(time.Hour).Unix(), RefreshIn: refreshIn})
+	}))
+	t.Cleanup(server.Close)
+	return server, &refreshes
+}
+
+func TestStartTinyRefreshIn(t *testing.T) {
+	for _, refreshIn := range []int64{0, 1, 10} {
+		server, refreshes := tokenServer(t, refreshIn)
+		ts := NewTokenSource("oauth")
+		ts.TokenEndpoint = server.URL
+
+		ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+		_ = ts.Start(ctx)
+		cancel()
+		if got := refreshes.Load(); got != 1 {
+			t.Errorf("refresh_in %d: %d refreshes in 300ms, want 1", refreshIn, got)
+		}
+	}
+}
+
+func TestRefreshDelay(t *testing.T) {
+	tests := []struct {
+		name        string
+		lead        time.Duration
+		maxTokenAge time.Duration
+		refreshIn   int64
+		want        time.Duration
+	}{
+		{"lead before refresh_in", 10 * time.Second, 0, 1500, 1490 * time.Second},
+		{"no lead", 0, 0, 1500, 1500 * time.Second},
+		{"refresh_in at the lead", 10 * time.Second, 0, 10, refreshTickInterval},
+		{"refresh_in below the lead", time.Minute, 0, 30, refreshTickInterval},
+		{"refresh_in zero", 10 * time.Second, 0, 0, refreshTickInterval},
+		{"just over the lead", 10 * time.Second, 0, 15, refreshTickInterval},
+		{"max token age", 10 * time.Second, 5 * time.Minute, 1500, 290 * time.Second},
+		{"max token age at the lead", 10 * time.Second, 10 * time.Second, 1500, refreshTickInterval},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := NewTokenSource("oauth")
+			ts.RefreshLead = tt.lead
+			ts.MaxTokenAge = tt.maxTokenAge
+			if got := ts.refreshDelay(tt.refreshIn); got != tt.want {
+				t.Errorf("refreshDelay(%d) = %s, want %s", tt.refreshIn, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadyMargin(t *testing.T) {
+	tests := []struct {
+		name      string
+		lead      time.Duration
+		grace     time.Duration
+		expiresIn time.Duration
+		want      bool
+	}{
+		{"well before the lead", 10 * time.Second, 0, time.Minute, true},
+		{"just before the lead", 10 * time.Second, 0, 12 * time.Second, true},
+		{"within the lead", 10 * time.Second, 0, 8 * time.Second, false},
+		{"expired", 10 * time.Second, 0, -time.Second, false},
+		{"no lead", 0, 0, 2 * time.Second, true},
+		{"expired within the grace", 10 * time.Second, time.Minute, -30 * time.Second, true},
+		{"expired past the grace", 10 * time.Second, time.Minute, -2 * time.Minute, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := NewTokenSource("oauth")
+			ts.RefreshLead = tt.lead
+			ts.ExpiryGrace = tt.grace
+			ts.apiToken = APIToken{Token: "token", ExpiresAt: time.Now().Add(tt.expiresIn).Unix()}
+			ts.obtainedAt = time.Now()
+			if got := ts.Ready(); got != tt.want {
+				t.Errorf("Ready() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRefreshTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	ts := NewTokenSource("oauth")
+	ts.TokenEndpoint = server.URL
+	ts.RefreshTimeout = 50 * time.Millisecond
+
+	start := time.Now()
+	err := ts.RefreshNow(context.Background())
+	if err == nil {
+		t.Fatal("RefreshNow succeeded against a server that never answers")
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("RefreshNow error = %v, want a deadline exceeded error", err)
+	}
+	if kind := RefreshErrorKindOf(err); kind != RefreshErrorTransient {
+		t.Errorf("error kind = %s, want transient so that the refresh is retried", kind)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("RefreshNow took %s with a 50ms timeout", elapsed)
+	}
+}
+
+func TestPromoteNext(t *testing.T) {
+	t0 := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	now := t0
+	ts := NewTokenSource("oauth")
+	ts.now = func() time.Time { return now }
+	ts.PrefetchLead = 30 * time.Second
+
+	ts.setAPIToken(APIToken{Token: "current", ExpiresAt: t0.Add(30 * time.Minute).Unix(), RefreshIn: 110}, 0)
+	refreshAt := t0.Add(100 * time.Second)
+	if ts.refreshAt != refreshAt {
+		t.Fatalf("refreshAt = %s, want %s", ts.refreshAt, refreshAt)
+	}
+	if got := ts.untilNextRefresh(); got != 70*time.Second {
+		t.Errorf("untilNextRefresh() = %s, want the prefetch lead before refreshAt", got)
+	}
+
+	now = t0.Add(69 * time.Second)
+	if ts.prefetchDue() {
+		t.Error("prefetch due before the prefetch lead")
+	}
+	now = t0.Add(70 * time.Second)
+	if !ts.prefetchDue() {
+		t.Error("prefetch not due at the prefetch lead")
+	}
+	ts.stageAPIToken(APIToken{Token: "next", ExpiresAt: now.Add(30 * time.Minute).Unix(), RefreshIn: 1500}, 0)
+	if ts.prefetchDue() {
+		t.Error("prefetch due with a token staged")
+	}
+
+	now = refreshAt.Add(-time.Second)
+	if ts.promoteNext() || ts.Token() != "current" {
+		t.Fatalf("promoted before the refresh boundary, token %q", ts.Token())
+	}
+	now = refreshAt
+	if !ts.promoteNext() || ts.Token() != "next" {
+		t.Fatalf("not promoted at the refresh boundary, token %q", ts.Token())
+	}
+	// The promoted token is scheduled from when it was fetched.
+	if want := t0.Add(70*time.Second + 1490*time.Second); ts.refreshAt != want {
+		t.Errorf("refreshAt = %s, want %s", ts.refreshAt, want)
+	}
+	if ts.promoteNext() {
+		t.Error("promoted twice")
+	}
+}
+
+func TestPromoteNextDropsExpired(t *testing.T) {
+	t0 := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	now := t0
+	ts := NewTokenSource("oauth")
+	ts.now = func() time.Time { return now }
+	ts.PrefetchLead = 30 * time.Second
+
+	ts.setAPIToken(APIToken{Token: "current", ExpiresAt: t0.Add(time.Hour).Unix(), RefreshIn: 110}, 0)
+	ts.stageAPIToken(APIToken{Token: "next", ExpiresAt: t0.Add(2 * time.Minute).Unix(), RefreshIn: 60}, 0)
+
+	now = t0.Add(115 * time.Second)
+	if ts.promoteNext() || ts.Token() != "current" {
+		t.Fatalf("promoted a token within RefreshLead of its expiry, token %q", ts.Token())
+	}
+	if !ts.prefetchDue() {
+		t.Error("prefetch not due after dropping the staged token")
+	}
+}
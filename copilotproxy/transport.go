@@ -0,0 +1,355 @@
+package copilotproxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// bufferBody reads the body of req into memory and sets GetBody, so that
+// the request can be sent again.
+func bufferBody(req *http.Request) error {
+	if req.Body == nil || req.Body == http.NoBody || req.GetBody != nil {
+		return nil
+	}
+	data, err := io.ReadAll(req.Body)
+	_ = req.Body.Close()
+	if err != nil {
+		return fmt.Errorf("failed to buffer request body: %w", err)
+	}
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+	req.Body, _ = req.GetBody()
+	return nil
+}
+
+// canReplay reports whether req has no body, a replayable one or one small
+// enough to buffer for sending it again.
+func canReplay(req *http.Request) bool {
+	if req.Body == nil || req.Body == http.NoBody || req.GetBody != nil {
+		return true
+	}
+	return req.ContentLength >= 0 && req.ContentLength <= maxRetryBodyBuffer
+}
+
+// recordUpstream keeps the outcome of the upstream round trip in the
+// request info, so that middleware can tell upstream failures from
+// responses written locally.
+type recordUpstream struct {
+	next http.RoundTripper
+}
+
+func (t recordUpstream) RoundTrip(req *http.Request) (*http.Response, error) {
+	rsp, err := t.next.RoundTrip(req)
+	info := requestInfoFrom(req.Context())
+	info.upstreamDone = true
+	info.upstreamCode = 0
+	if err == nil {
+		info.upstreamCode = rsp.StatusCode
+	}
+	return rsp, err
+}
+
+type failoverTransport struct {
+	upstreams []*url.URL
+	next      http.RoundTripper
+}
+
+func newFailoverTransport(upstreams []*url.URL, next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &failoverTransport{upstreams: upstreams, next: next}
+}
+
+func (t *failoverTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	info := requestInfoFrom(req.Context())
+	if len(t.upstreams) == 1 || info.inbound == nil || info.pinned {
+		info.upstream = req.URL.Host
+		info.upstreamPath = req.URL.Path
+		return t.next.RoundTrip(req)
+	}
+
+	if err := bufferBody(req); err != nil {
+		return nil, err
+	}
+
+	for i, upstream := range t.upstreams {
+		out := req
+		if i > 0 {
+			out = req.Clone(req.Context())
+			out.URL = new(url.URL)
+			*out.URL = *info.inbound
+			setUpstreamURL(&httputil.ProxyRequest{In: req, Out: out}, upstream)
+			if req.GetBody != nil {
+				out.Body, _ = req.GetBody()
+			}
+		}
+
+		info.upstream = upstream.Host
+		info.upstreamPath = out.URL.Path
+		rsp, err := t.next.RoundTrip(out)
+		last := i == len(t.upstreams)-1
+		if last || req.Context().Err() != nil {
+			return rsp, err
+		}
+		if err != nil {
+			slog.Warn("upstream failed, trying next", "upstream", upstream.Host, "error", err)
+			continue
+		}
+		if rsp.StatusCode >= http.StatusInternalServerError {
+			slog.Warn("upstream failed, trying next", "upstream", upstream.Host, "status", rsp.StatusCode)
+			_ = rsp.Body.Close()
+			continue
+		}
+		return rsp, nil
+	}
+	panic("unreachable")
+}
+
+// RetryPolicy controls how upstream requests failing with 429 or a
+// transient 5xx are retried. Retries happen before the response is passed
+// on, so streams are only retried before the client has seen a byte.
+type RetryPolicy struct {
+	Max     int
+	Backoff time.Duration
+	Budget  *RetryBudget
+}
+
+// RetryBudget caps retries to a fraction of the upstream requests, so that
+// retries cannot multiply the load of an upstream that is already failing.
+type RetryBudget struct {
+	mu      sync.Mutex
+	ratio   float64
+	balance float64
+}
+
+const retryBudgetBurst = 10
+
+// NewRetryBudget returns a budget allowing ratio retries per request, e.g.
+// 0.2 for one retry every five requests, plus a small burst.
+func NewRetryBudget(ratio float64) *RetryBudget {
+	return &RetryBudget{ratio: ratio, balance: retryBudgetBurst}
+}
+
+func (b *RetryBudget) deposit() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.balance = min(b.balance+b.ratio, retryBudgetBurst)
+}
+
+func (b *RetryBudget) withdraw() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.balance < 1 {
+		return false
+	}
+	b.balance--
+	return true
+}
+
+const (
+	maxRetryBackoff    = 10 * time.Second
+	maxRetryAfter      = 30 * time.Second
+	maxRetryBodyBuffer = 32 << 20
+)
+
+type retryTransport struct {
+	policy RetryPolicy
+	next   http.RoundTripper
+}
+
+func newRetryTransport(policy RetryPolicy, next http.RoundTripper) http.RoundTripper {
+	if policy.Max <= 0 {
+		return next
+	}
+	return &retryTransport{policy: policy, next: next}
+}
+
+func isRetryableStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.policy.Budget.deposit()
+	if !canReplay(req) {
+		return t.next.RoundTrip(req)
+	}
+	if err := bufferBody(req); err != nil {
+		return nil, err
+	}
+
+	for attempt := 0; ; attempt++ {
+		out := req
+		if attempt > 0 {
+			out = req.Clone(req.Context())
+			if req.GetBody != nil {
+				out.Body, _ = req.GetBody()
+			}
+		}
+		rsp, err := t.next.RoundTrip(out)
+		if attempt >= t.policy.Max || req.Context().Err() != nil {
+			return rsp, err
+		}
+
+		reason := "error"
+		var retryAfter time.Duration
+		if err == nil {
+			if !isRetryableStatus(rsp.StatusCode) {
+				return rsp, nil
+			}
+			reason = strconv.Itoa(rsp.StatusCode)
+			retryAfter = parseRetryAfter(rsp.Header.Get("Retry-After"))
+		}
+		if retryAfter > maxRetryAfter || !t.policy.Budget.withdraw() {
+			return rsp, err
+		}
+
+		wait := max(retryBackoff(t.policy.Backoff, attempt), retryAfter)
+		slog.Warn("retrying upstream request", "url", req.URL.String(), "attempt", attempt+1, "reason", reason, "wait", wait.String(), "error", err)
+		upstreamRetries.Inc(reason)
+		if err == nil {
+			_, _ = io.Copy(io.Discard, io.LimitReader(rsp.Body, 64<<10))
+			_ = rsp.Body.Close()
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// retryBackoff doubles base with every attempt, with up to 50% jitter.
+func retryBackoff(base time.Duration, attempt int) time.Duration {
+	backoff := min(base<<attempt, maxRetryBackoff)
+	if backoff <= 0 {
+		return 0
+	}
+	return backoff/2 + rand.N(backoff/2+1)
+}
+
+// tokenRetryTransport sends a request rejected with 401 once more after
+// refreshing the token, in case it was revoked or expired early. Only 401s
+// of the Copilot API count, not those of other upstreams a client selected.
+type tokenRetryTransport struct {
+	ts   *TokenSource
+	host string
+	next http.RoundTripper
+}
+
+func newTokenRetryTransport(ts *TokenSource, upstream *url.URL, next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &tokenRetryTransport{ts: ts, host: strings.ToLower(upstream.Hostname()), next: next}
+}
+
+func (t *tokenRetryTransport) isCopilotHost(host string) bool {
+	host = strings.ToLower(host)
+	return host == t.host || host == "githubcopilot.com" || strings.HasSuffix(host, ".githubcopilot.com")
+}
+
+func (t *tokenRetryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !canReplay(req) || !t.isCopilotHost(req.URL.Hostname()) {
+		return t.next.RoundTrip(req)
+	}
+	if err := bufferBody(req); err != nil {
+		return nil, err
+	}
+	rsp, err := t.next.RoundTrip(req)
+	if err != nil || rsp.StatusCode != http.StatusUnauthorized || req.Context().Err() != nil {
+		return rsp, err
+	}
+
+	rejected, _ := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	slog.Warn("upstream rejected token, refreshing and retrying", "url", req.URL.String())
+	if err := t.ts.refreshRejected(req.Context(), rejected); err != nil {
+		if errors.Is(err, errRejectedTooSoon) {
+			slog.Warn("not refreshing the token after upstream 401, it was just obtained", "min_interval", minRejectedRefreshInterval)
+		} else {
+			slog.Error("token refresh after upstream 401 failed", "error", err)
+		}
+		return rsp, nil
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(rsp.Body, 64<<10))
+	_ = rsp.Body.Close()
+
+	out := req.Clone(req.Context())
+	if req.GetBody != nil {
+		out.Body, _ = req.GetBody()
+	}
+	out.Header.Set("Authorization", "Bearer "+t.ts.Token())
+	upstreamRetries.Inc("token")
+	return t.next.RoundTrip(out)
+}
+
+type TransportOptions struct {
+	MaxIdleConns          int
+	MaxIdleConnsPerHost   int
+	IdleConnTimeout       time.Duration
+	ResponseHeaderTimeout time.Duration
+	CAFile                string
+	InsecureSkipVerify    bool
+}
+
+func NewUpstreamTransport(opts TransportOptions) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = opts.MaxIdleConns
+	transport.MaxIdleConnsPerHost = opts.MaxIdleConnsPerHost
+	transport.IdleConnTimeout = opts.IdleConnTimeout
+	transport.ResponseHeaderTimeout = opts.ResponseHeaderTimeout
+
+	if opts.CAFile != "" || opts.InsecureSkipVerify {
+		transport.TLSClientConfig = &tls.Config{
+			MinVersion:         tls.VersionTLS12,
+			InsecureSkipVerify: opts.InsecureSkipVerify,
+		}
+	}
+
+	if opts.CAFile != "" {
+		data, err := os.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", opts.CAFile)
+		}
+		transport.TLSClientConfig.RootCAs = pool
+	}
+
+	return transport, nil
+}
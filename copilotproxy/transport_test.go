@@ -0,0 +1,167 @@
+package copilotproxy
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTokenRetryTransport(t *testing.T) {
+	tests := []struct {
+		name      string
+		url       string
+		age       time.Duration
+		want      int
+		refreshes int32
+	}{
+		{"copilot upstream", "https://api.githubcopilot.com/chat/completions", time.Minute, http.StatusOK, 1},
+		{"copilot subdomain", "https://api.business.githubcopilot.com/chat/completions", time.Minute, http.StatusOK, 1},
+		{"configured upstream", "https://copilot.example.com:8443/chat/completions", time.Minute, http.StatusOK, 1},
+		{"other upstream", "https://llm.example.org/chat/completions", time.Minute, http.StatusUnauthorized, 0},
+		{"token just obtained", "https://api.githubcopilot.com/chat/completions", time.Second, http.StatusUnauthorized, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var refreshes atomic.Int32
+			tokens := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				refreshes.Add(1)
+				_ = json.NewEncoder(w).Encode(APIToken{Token: "new", ExpiresAt: time.Now().Add(time.Hour).Unix(), RefreshIn: 1500})
+			}))
+			defer tokens.Close()
+
+			ts := NewTokenSource("oauth")
+			ts.TokenEndpoint = tokens.URL
+			ts.apiToken = APIToken{Token: "old", ExpiresAt: time.Now().Add(time.Hour).Unix()}
+			ts.obtainedAt = time.Now().Add(-tt.age)
+
+			upstream := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				if req.Header.Get("Authorization") != "Bearer new" {
+					return &http.Response{StatusCode: http.StatusUnauthorized, Body: http.NoBody}, nil
+				}
+				return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+			})
+			rt := newTokenRetryTransport(ts, &url.URL{Scheme: "https", Host: "Copilot.example.com:8443"}, upstream)
+
+			req := httptest.NewRequest(http.MethodPost, tt.url, nil)
+			req.Header.Set("Authorization", "Bearer old")
+			rsp, err := rt.RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rsp.StatusCode != tt.want {
+				t.Errorf("status = %d, want %d", rsp.StatusCode, tt.want)
+			}
+			if got := refreshes.Load(); got != tt.refreshes {
+				t.Errorf("refreshes = %d, want %d", got, tt.refreshes)
+			}
+		})
+	}
+}
+
+func TestResponseHeaderTimeout(t *testing.T) {
+	delay := 200 * time.Millisecond
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		wantErr bool
+	}{
+		{"delayed headers", func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-time.After(delay):
+			case <-r.Context().Done():
+			}
+			_, _ = w.Write([]byte("data: late\n\n"))
+		}, true},
+		{"delay between chunks", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/event-stream")
+			for i := range 3 {
+				if i > 0 {
+					time.Sleep(delay)
+				}
+				_, _ = w.Write([]byte("data: chunk\n\n"))
+				_ = http.NewResponseController(w).Flush()
+			}
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(tt.handler)
+			defer server.Close()
+			transport, err := NewUpstreamTransport(TransportOptions{ResponseHeaderTimeout: delay / 2})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer transport.CloseIdleConnections()
+
+			req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+			rsp, err := transport.RoundTrip(req)
+			if tt.wantErr {
+				if err == nil {
+					rsp.Body.Close()
+					t.Fatal("RoundTrip succeeded although the headers came after the timeout")
+				}
+				if code, _ := upstreamErrorStatus(err); code != http.StatusGatewayTimeout {
+					t.Errorf("status for %v = %d, want %d", err, code, http.StatusGatewayTimeout)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rsp.Body.Close()
+			body, err := io.ReadAll(rsp.Body)
+			if err != nil {
+				t.Fatalf("reading a slow stream after its headers: %v", err)
+			}
+			if want := "data: chunk\n\n"; string(body) != want+want+want {
+				t.Errorf("body = %q", body)
+			}
+		})
+	}
+}
+
+// BenchmarkUpstreamTransport sends requests from at least 32 goroutines
+// through the transport with the default pool settings and reports how many
+// upstream connections were opened.
+func BenchmarkUpstreamTransport(b *testing.B) {
+	var conns atomic.Int64
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"object":"list","data":[]}`))
+	}))
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	transport, err := NewUpstreamTransport(TransportOptions{MaxIdleConns: 100, MaxIdleConnsPerHost: 64, IdleConnTimeout: 5 * time.Minute})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer transport.CloseIdleConnections()
+
+	b.SetParallelism(32 / max(1, runtime.GOMAXPROCS(0)))
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			req, _ := http.NewRequest(http.MethodGet, server.URL+"/models", nil)
+			rsp, err := transport.RoundTrip(req)
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			_, _ = io.Copy(io.Discard, rsp.Body)
+			_ = rsp.Body.Close()
+		}
+	})
+	b.ReportMetric(float64(conns.Load()), "conns")
+}
@@ -0,0 +1,387 @@
+package copilotproxy
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// UsageRecord is a proxied request as kept by a UsageStore.
+type UsageRecord struct {
+	Time             time.Time
+	Key              string
+	Account          string
+	Model            string
+	Path             string
+	Status           int
+	Stream           bool
+	PromptTokens     int64
+	CompletionTokens int64
+	Latency          time.Duration
+}
+
+const usageSchema = `
+CREATE TABLE IF NOT EXISTS usage (
+	id                INTEGER PRIMARY KEY,
+	time              INTEGER NOT NULL,
+	api_key           TEXT    NOT NULL,
+	account           TEXT    NOT NULL,
+	model             TEXT    NOT NULL,
+	path              TEXT    NOT NULL,
+	status            INTEGER NOT NULL,
+	stream            INTEGER NOT NULL,
+	prompt_tokens     INTEGER NOT NULL,
+	completion_tokens INTEGER NOT NULL,
+	latency_ms        INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS usage_api_key_time ON usage (api_key, time);
+CREATE INDEX IF NOT EXISTS usage_time ON usage (time);
+`
+
+const (
+	usageQueueSize = 1024
+	usageBatchSize = 128
+)
+
+// UsageStore persists UsageRecords to a SQLite database. Records are queued
+// and written in batches so that requests never wait for the disk.
+type UsageStore struct {
+	db *sql.DB
+
+	mu        sync.RWMutex
+	closed    bool
+	records   chan UsageRecord
+	done      chan struct{}
+	observers []func(UsageRecord)
+}
+
+// OpenUsageStore opens the SQLite database at file, creating it and its
+// schema if needed.
+func OpenUsageStore(file string) (*UsageStore, error) {
+	db, err := sql.Open("sqlite", "file:"+file+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=synchronous(NORMAL)")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open usage database: %w", err)
+	}
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(usageSchema); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to create usage schema in %s: %w", file, err)
+	}
+
+	s := &UsageStore{
+		db:      db,
+		records: make(chan UsageRecord, usageQueueSize),
+		done:    make(chan struct{}),
+	}
+	go s.run()
+	return s, nil
+}
+
+// Observe calls fn with every record passed to Record from now on, whether
+// or not it gets written.
+func (s *UsageStore) Observe(fn func(UsageRecord)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.observers = append(s.observers, fn)
+}
+
+// Record queues rec to be written. When the queue is full the record is
+// dropped rather than slowing down the request.
+func (s *UsageStore) Record(rec UsageRecord) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return
+	}
+	for _, fn := range s.observers {
+		fn(rec)
+	}
+	select {
+	case s.records <- rec:
+	default:
+		usageRecordsDropped.Inc()
+	}
+}
+
+// Close writes the queued records and closes the database.
+func (s *UsageStore) Close() error {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.records)
+	}
+	s.mu.Unlock()
+
+	<-s.done
+	return s.db.Close()
+}
+
+func (s *UsageStore) run() {
+	defer close(s.done)
+
+	batch := make([]UsageRecord, 0, usageBatchSize)
+	for rec := range s.records {
+		batch = append(batch[:0], rec)
+	fill:
+		for len(batch) < usageBatchSize {
+			select {
+			case rec, ok := <-s.records:
+				if !ok {
+					break fill
+				}
+				batch = append(batch, rec)
+			default:
+				break fill
+			}
+		}
+		if err := s.insert(batch); err != nil {
+			usageRecordsDropped.Add(float64(len(batch)))
+			slog.Warn("failed to write usage records", "records", len(batch), "error", err)
+		}
+	}
+}
+
+func (s *UsageStore) insert(batch []UsageRecord) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`INSERT INTO usage (time, api_key, account, model, path, status, stream, prompt_tokens, completion_tokens, latency_ms) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, rec := range batch {
+		if _, err := stmt.Exec(rec.Time.UnixMilli(), rec.Key, rec.Account, rec.Model, rec.Path, rec.Status, rec.Stream, rec.PromptTokens, rec.CompletionTokens, rec.Latency.Milliseconds()); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// TokensSince returns the prompt and completion tokens recorded for key
+// since the given time. Records still queued are not included.
+func (s *UsageStore) TokensSince(ctx context.Context, key string, since time.Time) (int64, error) {
+	var tokens int64
+	err := s.db.QueryRowContext(ctx, `SELECT COALESCE(SUM(prompt_tokens + completion_tokens), 0) FROM usage WHERE api_key = ? AND time >= ?`, key, since.UnixMilli()).Scan(&tokens)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query usage: %w", err)
+	}
+	return tokens, nil
+}
+
+// TokensByKeySince returns the prompt and completion tokens recorded since
+// the given time for each key.
+func (s *UsageStore) TokensByKeySince(ctx context.Context, since time.Time) (map[string]int64, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT api_key, SUM(prompt_tokens + completion_tokens) FROM usage WHERE time >= ? GROUP BY api_key`, since.UnixMilli())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query usage: %w", err)
+	}
+	defer rows.Close()
+
+	tokens := make(map[string]int64)
+	for rows.Next() {
+		var key string
+		var n int64
+		if err := rows.Scan(&key, &n); err != nil {
+			return nil, fmt.Errorf("failed to read usage: %w", err)
+		}
+		tokens[key] = n
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read usage: %w", err)
+	}
+	return tokens, nil
+}
+
+const maxUsageResponseBytes = 8 << 20
+
+// RecordUsage records every request passing through it in store, with the
+// token counts reported in the usage object of JSON responses or in the
+// final chunk of chat completion streams. With countTokens, the counts are
+// kept for outer middleware even without a store.
+func RecordUsage(store *UsageStore, countTokens bool) Middleware {
+	return func(next http.Handler) http.Handler {
+		if store == nil && !countTokens {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r, info := withRequestInfo(r)
+			info.countUsage = true
+			uw := &usageWriter{ResponseWriter: w, info: info}
+			start := time.Now()
+
+			next.ServeHTTP(uw, r)
+			uw.finish()
+
+			if uw.code == 0 {
+				uw.code = http.StatusOK
+			}
+			usage := UsageRecord{
+				Time:             start,
+				Key:              info.key,
+				Account:          info.account,
+				Model:            info.model,
+				Path:             r.URL.Path,
+				Status:           uw.code,
+				Stream:           info.stream || uw.stream,
+				PromptTokens:     uw.prompt,
+				CompletionTokens: uw.completion,
+				Latency:          time.Since(start),
+			}
+			if uw.code < 300 && !uw.stream && !uw.over && uw.header.Get("X-Cache") != "HIT" {
+				usage.PromptTokens, usage.CompletionTokens = responseUsage(uw.header, uw.body.Bytes())
+			}
+			info.promptTokens, info.completionTokens = usage.PromptTokens, usage.CompletionTokens
+			if store != nil {
+				store.Record(usage)
+			}
+		})
+	}
+}
+
+type tokenUsage struct {
+	PromptTokens     int64 `json:"prompt_tokens"`
+	CompletionTokens int64 `json:"completion_tokens"`
+}
+
+// usageWriter captures JSON responses and reads the usage chunk of event
+// streams as they pass. A usage chunk the client did not ask for, because
+// it was only requested upstream for accounting, is left out.
+type usageWriter struct {
+	http.ResponseWriter
+	info *requestInfo
+
+	code   int
+	header http.Header
+	stream bool
+	body   bytes.Buffer
+	over   bool
+
+	pending   []byte
+	dropBlank bool
+
+	prompt, completion int64
+}
+
+func (uw *usageWriter) WriteHeader(code int) {
+	if uw.code == 0 {
+		uw.code = code
+		uw.header = uw.ResponseWriter.Header().Clone()
+		uw.stream = isEventStream(uw.header) && uw.header.Get("Content-Encoding") == ""
+	}
+	uw.ResponseWriter.WriteHeader(code)
+}
+
+func (uw *usageWriter) Write(b []byte) (int, error) {
+	if uw.code == 0 {
+		uw.WriteHeader(http.StatusOK)
+	}
+	if !uw.stream {
+		if !uw.over {
+			if uw.body.Len()+len(b) > maxUsageResponseBytes {
+				uw.over = true
+				uw.body.Reset()
+			} else {
+				uw.body.Write(b)
+			}
+		}
+		return uw.ResponseWriter.Write(b)
+	}
+
+	if !uw.info.stripUsage {
+		n, err := uw.ResponseWriter.Write(b)
+		uw.scan(b[:n], nil)
+		return n, err
+	}
+	var out bytes.Buffer
+	uw.scan(b, &out)
+	if out.Len() > 0 {
+		if _, err := uw.ResponseWriter.Write(out.Bytes()); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// scan reads the complete lines of b, keeping the last usage reported. When
+// out is not nil, the lines to pass on are written to it.
+func (uw *usageWriter) scan(b []byte, out *bytes.Buffer) {
+	uw.pending = append(uw.pending, b...)
+	for {
+		i := bytes.IndexByte(uw.pending, '\n')
+		if i < 0 {
+			if out == nil && len(uw.pending) > maxUsageResponseBytes {
+				uw.pending = nil
+			}
+			return
+		}
+		line := uw.pending[:i+1]
+		uw.pending = uw.pending[i+1:]
+
+		trimmed := bytes.TrimSpace(line)
+		if len(trimmed) == 0 && uw.dropBlank {
+			uw.dropBlank = false
+			continue
+		}
+		if data, ok := bytes.CutPrefix(trimmed, []byte("data:")); ok {
+			var chunk struct {
+				Choices []json.RawMessage `json:"choices"`
+				Usage   *tokenUsage       `json:"usage"`
+			}
+			if json.Unmarshal(bytes.TrimSpace(data), &chunk) == nil && chunk.Usage != nil {
+				uw.prompt, uw.completion = chunk.Usage.PromptTokens, chunk.Usage.CompletionTokens
+				if out != nil && len(chunk.Choices) == 0 {
+					uw.dropBlank = true
+					continue
+				}
+			}
+		}
+		if out != nil {
+			out.Write(line)
+		}
+	}
+}
+
+// finish passes on a trailing incomplete line held back by scan.
+func (uw *usageWriter) finish() {
+	if uw.stream && uw.info.stripUsage && len(uw.pending) > 0 {
+		_, _ = uw.ResponseWriter.Write(uw.pending)
+	}
+	uw.pending = nil
+}
+
+func (uw *usageWriter) Unwrap() http.ResponseWriter {
+	return uw.ResponseWriter
+}
+
+func responseUsage(header http.Header, body []byte) (prompt, completion int64) {
+	if !strings.Contains(header.Get("Content-Type"), "json") {
+		return 0, 0
+	}
+	body, err := decodeBody(header.Get("Content-Encoding"), body, maxUsageResponseBytes)
+	if err != nil {
+		return 0, 0
+	}
+	var response struct {
+		Usage *tokenUsage `json:"usage"`
+	}
+	if json.Unmarshal(body, &response) != nil || response.Usage == nil {
+		return 0, 0
+	}
+	return response.Usage.PromptTokens, response.Usage.CompletionTokens
+}
@@ -1,111 +1,650 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log/slog"
+	"net"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+
+	"git.tigerbrokers.net/pangxuyuanp/copilot-api/copilotproxy"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.yaml.in/yaml/v3"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/netutil"
 )
 
-const (
-	OAuthTokenEndpoint = "https://api.github.com/copilot_internal/v2/token"
-	APIEndpoint        = "https://api.githubcopilot.com"
-	GitHubAPIEndpoint  = "https://api.github.com"
+var (
+	version   = "dev"
+	commit    = "dev"
+	buildDate = "dev"
 )
 
-func init() {
-	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
-		AddSource: true,
-	}))
-	slog.SetDefault(logger)
+type stringSlice []string
+
+func (s *stringSlice) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringSlice) Set(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*s = append(*s, item)
+		}
+	}
+	return nil
 }
 
-type APIToken struct {
-	ExpiresAt int64  `json:"expires_at"`
-	RefreshIn int64  `json:"refresh_in"`
-	Token     string `json:"token"`
+// credentialList collects name:secret flag values. Unlike stringSlice it
+// does not split on commas, which may appear in the secret.
+type credentialList []string
+
+func (c *credentialList) String() string {
+	return strings.Join(*c, ",")
 }
 
-type TokenSource struct {
-	mu         sync.RWMutex
-	apiToken   APIToken
-	oauthToken string
+func (c *credentialList) Set(value string) error {
+	*c = append(*c, value)
+	return nil
+}
 
-	client *http.Client
+// masked lists the names with their secrets replaced by ****.
+func (c *credentialList) masked() string {
+	names := make([]string, 0, len(*c))
+	for _, cred := range *c {
+		name, _, _ := strings.Cut(cred, ":")
+		names = append(names, name+":****")
+	}
+	return strings.Join(names, ",")
 }
 
-func NewTokenSource(oauthToken string) *TokenSource {
-	return &TokenSource{
-		oauthToken: oauthToken,
+type headerValues http.Header
+
+func (h headerValues) String() string {
+	pairs := make([]string, 0, len(h))
+	for key, values := range h {
+		for _, value := range values {
+			pairs = append(pairs, key+"="+value)
+		}
+	}
+	return strings.Join(pairs, ",")
+}
 
-		client: http.DefaultClient,
+func (h headerValues) Set(value string) error {
+	key, val, ok := strings.Cut(value, "=")
+	key = strings.TrimSpace(key)
+	if !ok || key == "" {
+		return fmt.Errorf("expected key=value, got %q", value)
 	}
+	http.Header(h).Add(key, strings.TrimSpace(val))
+	return nil
 }
 
-func (ts *TokenSource) Start(ctx context.Context) {
-	var timeout <-chan time.Time
-	var retry <-chan time.Time
+type options struct {
+	Config string
+
+	OAuthToken       string
+	OAuthTokenFile   string
+	AccessToken      string
+	AccessTokensFile string
+	AccessKeys       credentialList
+	AccountsFile     string
+	Balance          string
+	Addr             string
+	BasePath         string
+	AllowCIDRs       stringSlice
+	TrustProxy       bool
+	BasicAuth        credentialList
+	RequireAuth      bool
+	MaxRequests      int64
+
+	KeyRequestsPerMinute int
+	KeyTokensPerMinute   int
+	KeyDailyTokens       int64
+	KeyMonthlyTokens     int64
+	KeyQuotas            stringSlice
+	OTelEndpoint         string
+	NoAppsJSON           bool
+	CopilotUser          string
+
+	RefreshLead     time.Duration
+	RefreshTimeout  time.Duration
+	ExpiryGrace     time.Duration
+	WaitReady       bool
+	FatalOnAuth     bool
+	MaxTokenAge     time.Duration
+	PrefetchLead    time.Duration
+	TokenCacheDir   string
+	NoTokenCache    bool
+	AlertWebhook    string
+	AlertAfter      int
+	AlertDebounce   time.Duration
+	StartupJitter   time.Duration
+	TokenAuthScheme string
+	TokenHeaders    headerValues
+
+	Upstreams             stringSlice
+	APIEndpoint           string
+	TokenEndpoint         string
+	IntegrationID         string
+	IntegrationIDs        stringSlice
+	DefaultModel          string
+	AllowUpstreams        stringSlice
+	AllowPaths            stringSlice
+	DenyPaths             stringSlice
+	MaxIdleConns          int
+	MaxIdleConnsPerHost   int
+	IdleConnTimeout       time.Duration
+	ResponseHeaderTimeout time.Duration
+	UpstreamRetries       int
+	UpstreamRetryBackoff  time.Duration
+	UpstreamRetryBudget   float64
+	UpstreamCA            string
+	InsecureSkipVerify    bool
+
+	StripResponseHeaders stringSlice
+	AddResponseHeaders   headerValues
+	RemapStatus          stringSlice
+
+	AccessLogSample float64
+
+	ModelsFile     string
+	ModelsCacheTTL time.Duration
+
+	EmbeddingsCacheSize int
+	EmbeddingsCacheTTL  time.Duration
+
+	UsageDB string
+
+	Check       bool
+	CheckModels bool
+
+	H2C               bool
+	Anthropic         bool
+	Ollama            bool
+	SocketMode        string
+	TLSCert           string
+	TLSKey            string
+	HTTPSRedirectAddr string
+	ACMEDomains       stringSlice
+	ACMECacheDir      string
+	ACMEEmail         string
+	MaxConns          int
+	MaxHeaderBytes    int
+	ShutdownDelay     time.Duration
+	DrainTimeout      time.Duration
+
+	DegradeOnEntitlementError bool
+
+	DebugBodies    bool
+	DebugBodyBytes int
+
+	MaxBodyBytes       int64
+	DisableMiddlewares stringSlice
+	AllowUpgrades      bool
+	ValidateJSON       bool
+	RestrictMethods    bool
+	AllowMethods       stringSlice
+
+	BufferResponseBytes  int64
+	SlowRequestThreshold time.Duration
+	SSEKeepalive         time.Duration
+
+	BreakerFailures int
+	BreakerWindow   time.Duration
+	BreakerCooldown time.Duration
+
+	MaxConcurrent int
+	QueueDepth    int
+	QueueTimeout  time.Duration
+}
 
-	ticker := time.NewTicker(10 * time.Second)
-	defer ticker.Stop()
+func newFlagSet(opts *options, logLevel *slog.LevelVar) *flag.FlagSet {
+	acmeCacheDir := defaultCacheDir()
+	if acmeCacheDir != "" {
+		acmeCacheDir = filepath.Join(acmeCacheDir, "acme")
+	}
 
-	first := make(chan struct{})
-	close(first)
+	fs := flag.NewFlagSet("copilot-proxy", flag.ContinueOnError)
+	fs.StringVar(&opts.Config, "config", "", "YAML or JSON file with settings keyed by flag name; command line flags and COPILOT_PROXY_* environment variables take precedence")
+	fs.StringVar(&opts.OAuthToken, "oauth-token", "", "OAuth token for GitHub API, or - to read it from stdin")
+	fs.StringVar(&opts.OAuthTokenFile, "oauth-token-file", "", "File to read the OAuth token for GitHub API from")
+	fs.StringVar(&opts.Addr, "addr", ":8080", "Address to listen on, or unix:///path/to.sock for a Unix domain socket")
+	fs.StringVar(&opts.SocketMode, "socket-mode", "0660", "Octal file mode of the Unix domain socket created for a unix:// -addr")
+	fs.StringVar(&opts.AccessToken, "access-token", "", "Access token for OpenAI API")
+	fs.BoolVar(&opts.RequireAuth, "require-auth", false, "Refuse to start without an access token or basic auth credential")
+	fs.StringVar(&opts.AccessTokensFile, "access-tokens-file", "", "File with one name:token access token per line")
+	fs.Var(&opts.AccessKeys, "access-key", "Named access token as name:token[:scopes], repeatable; like a line of -access-tokens-file")
+	fs.StringVar(&opts.BasePath, "base-path", "/api/v1", "Base path for the API")
+	fs.Var(&opts.BasicAuth, "basic-auth", "Accepted HTTP Basic auth credential as user:pass, repeatable")
+	fs.Var(&opts.AllowCIDRs, "allow-cidr", "Allowed client CIDR, repeatable or comma-separated (default: allow all)")
+	fs.BoolVar(&opts.TrustProxy, "trust-proxy", false, "Trust X-Forwarded-For/X-Real-IP headers for the client IP")
+	fs.Int64Var(&opts.MaxRequests, "max-requests", 0, "Maximum number of proxied requests before refusing service (0 = unlimited)")
+	fs.IntVar(&opts.KeyRequestsPerMinute, "key-requests-per-minute", 0, "Maximum number of requests per minute for each access token (0 = unlimited)")
+	fs.IntVar(&opts.KeyTokensPerMinute, "key-tokens-per-minute", 0, "Maximum number of prompt and completion tokens per minute for each access token (0 = unlimited)")
+	fs.Int64Var(&opts.KeyDailyTokens, "key-daily-tokens", 0, "Token quota per day for each access token, requires -usage-db (0 = unlimited)")
+	fs.Int64Var(&opts.KeyMonthlyTokens, "key-monthly-tokens", 0, "Token quota per month for each access token, requires -usage-db (0 = unlimited)")
+	fs.Var(&opts.KeyQuotas, "key-quota", "Token quota of one access token as name:daily:monthly, overriding -key-daily-tokens and -key-monthly-tokens, repeatable")
+	fs.StringVar(&opts.APIEndpoint, "api-endpoint", copilotproxy.APIEndpoint, "Copilot API endpoint, used when -upstream is not set")
+	fs.StringVar(&opts.TokenEndpoint, "token-endpoint", copilotproxy.OAuthTokenEndpoint, "Copilot token exchange endpoint")
+	fs.Var(&opts.Upstreams, "upstream", "Copilot API upstream URL, repeatable or comma-separated; later ones are tried in order when earlier ones fail (default: -api-endpoint)")
+	fs.Var(&opts.AllowUpstreams, "allow-upstream", "Upstream URL clients may select per request with the X-Upstream header, repeatable or comma-separated")
+	fs.StringVar(&opts.IntegrationID, "integration-id", "vscode-chat", "Default Copilot-Integration-Id sent upstream")
+	fs.Var(&opts.IntegrationIDs, "allow-integration-id", "Copilot-Integration-Id clients may select with the X-Copilot-Integration header, repeatable or comma-separated")
+	fs.StringVar(&opts.DefaultModel, "default-model", "", "Model set in completion requests whose body has no or an empty model field")
+	fs.Var(&opts.AllowPaths, "allow-path", "Upstream API path prefix or glob to allow, repeatable or comma-separated (default: allow all)")
+	fs.Var(&opts.DenyPaths, "deny-path", "Upstream API path prefix or glob to deny, repeatable or comma-separated; takes precedence over -allow-path")
+	fs.IntVar(&opts.MaxIdleConns, "max-idle-conns", 100, "Maximum number of idle upstream connections")
+	fs.IntVar(&opts.MaxIdleConnsPerHost, "max-idle-conns-per-host", 64, "Maximum number of idle upstream connections per host")
+	fs.DurationVar(&opts.IdleConnTimeout, "idle-conn-timeout", 5*time.Minute, "How long an idle upstream connection is kept open")
+	fs.DurationVar(&opts.ResponseHeaderTimeout, "upstream-response-header-timeout", 0, "Abort an upstream request whose response headers take longer than this; streaming bodies may run longer afterwards (0 = no timeout)")
+	fs.IntVar(&opts.UpstreamRetries, "upstream-retries", 0, "Maximum number of retries of an upstream request failing with 429, a transient 5xx or a transport error (0 = no retries)")
+	fs.DurationVar(&opts.UpstreamRetryBackoff, "upstream-retry-backoff", 500*time.Millisecond, "Initial delay between upstream retries, doubled with every retry; a longer Retry-After is honored")
+	fs.Float64Var(&opts.UpstreamRetryBudget, "upstream-retry-budget", 0.2, "Fraction of upstream requests that may be retried, on top of a burst of 10 (0 = no limit)")
+	fs.StringVar(&opts.UpstreamCA, "upstream-ca", "", "PEM bundle of extra CA certificates trusted for upstream and token endpoint TLS")
+	fs.BoolVar(&opts.InsecureSkipVerify, "insecure-skip-verify", false, "INSECURE: skip upstream TLS certificate verification, for testing only")
+	fs.Var(&opts.RemapStatus, "remap-status", "Upstream status code to send to clients as another one, as from=to, repeatable or comma-separated")
+	fs.Var(&opts.StripResponseHeaders, "strip-response-header", "Upstream response header to remove, repeatable (case-insensitive)")
+	opts.AddResponseHeaders = make(headerValues)
+	fs.Var(opts.AddResponseHeaders, "add-response-header", "Extra key=value header added to responses, repeatable")
+	fs.DurationVar(&opts.RefreshLead, "refresh-lead", 10*time.Second, "Refresh the token this long before GitHub's refresh_in, and stop using it this long before it expires")
+	fs.DurationVar(&opts.RefreshTimeout, "refresh-timeout", 10*time.Second, "Timeout of a single token refresh request (0 = no timeout)")
+	fs.DurationVar(&opts.ExpiryGrace, "expiry-grace", 0, "Keep serving with the last token and reporting ready for this long after it expires while refreshes are failing")
+	fs.DurationVar(&opts.MaxTokenAge, "max-token-age", 0, "Refresh the Copilot token once it has been held this long, even if GitHub says it is still valid; 0 to follow GitHub's expiry")
+	fs.DurationVar(&opts.PrefetchLead, "prefetch-lead", 0, "Fetch the next Copilot token this long before the current one is due for refresh and keep it staged until then; 0 to disable")
+	fs.StringVar(&opts.TokenCacheDir, "token-cache-dir", defaultCacheDir(), "Directory the Copilot token is persisted to, so a restart can reuse it while it is valid")
+	fs.BoolVar(&opts.NoTokenCache, "no-token-cache", false, "Never persist the Copilot token to disk or reuse a persisted one")
+	fs.StringVar(&opts.AlertWebhook, "alert-webhook", "", "URL to POST a JSON alert to when token refreshes keep failing or the proxy becomes not ready")
+	fs.IntVar(&opts.AlertAfter, "alert-after", 3, "Consecutive token refresh failures before -alert-webhook is called")
+	fs.DurationVar(&opts.AlertDebounce, "alert-debounce", 5*time.Minute, "Minimum time between two alerts of the same kind")
+	fs.BoolVar(&opts.FatalOnAuth, "fatal-on-auth", false, "Exit when GitHub rejects the OAuth token during a background refresh instead of retrying slowly")
+	fs.BoolVar(&opts.WaitReady, "wait-ready", true, "Refresh the token synchronously before serving, exiting if GitHub rejects the OAuth token")
+	fs.DurationVar(&opts.StartupJitter, "startup-jitter", 0, "Delay the initial token refresh by a random duration up to this value (ignored with -wait-ready)")
+	fs.StringVar(&opts.TokenAuthScheme, "token-auth-scheme", "Bearer", "Authorization scheme used for the token endpoint")
+	opts.TokenHeaders = make(headerValues)
+	fs.Var(opts.TokenHeaders, "token-header", "Extra key=value header sent to the token endpoint, repeatable")
+	fs.BoolVar(&opts.DegradeOnEntitlementError, "degrade-on-entitlement-error", false, "Report not ready while the upstream rejects requests for subscription or quota reasons")
+	fs.IntVar(&opts.MaxHeaderBytes, "max-header-bytes", http.DefaultMaxHeaderBytes, "Maximum size of request headers in bytes; larger requests get 431")
+	fs.IntVar(&opts.MaxConns, "max-conns", 0, "Maximum number of simultaneously open client connections (0 = unlimited)")
+	fs.DurationVar(&opts.ShutdownDelay, "shutdown-delay", 0, "On SIGTERM/SIGINT, keep serving with /ready failing for this long before draining")
+	fs.DurationVar(&opts.DrainTimeout, "drain-timeout", 30*time.Second, "Maximum time to wait for in-flight requests on shutdown before closing their connections, 0 to wait forever")
+	fs.Float64Var(&opts.AccessLogSample, "access-log-sample", 1, "Fraction of successful requests written to the access log; non-2xx requests are always logged")
+	fs.StringVar(&opts.ModelsFile, "models-file", "", "Serve GET /models from this OpenAI-style models list JSON file instead of the upstream")
+	fs.DurationVar(&opts.ModelsCacheTTL, "models-cache-ttl", 5*time.Minute, "How long the upstream GET /models response is cached and served locally; a stale copy is served while the upstream fails (0 = disabled)")
+	fs.IntVar(&opts.EmbeddingsCacheSize, "embeddings-cache-size", 0, "Maximum number of /embeddings responses kept in an in-memory LRU cache (0 = disabled)")
+	fs.DurationVar(&opts.EmbeddingsCacheTTL, "embeddings-cache-ttl", time.Hour, "How long a cached /embeddings response is served")
+	fs.StringVar(&opts.UsageDB, "usage-db", "", "SQLite database file to record per-request usage (key, model, tokens, latency, status) in")
+	fs.BoolVar(&opts.Check, "check", false, "Verify the OAuth token and upstream connectivity, print a summary and exit without serving")
+	fs.BoolVar(&opts.CheckModels, "check-models", true, "Also fetch the upstream models list in -check mode")
+	fs.BoolVar(&opts.Anthropic, "anthropic", false, "Serve the Anthropic Messages API at POST /anthropic/v1/messages on top of the Copilot API")
+	fs.BoolVar(&opts.Ollama, "ollama", false, "Serve the Ollama /api/chat, /api/generate, /api/tags, /api/show and /api/version endpoints on top of the Copilot API")
+	fs.BoolVar(&opts.H2C, "h2c", false, "Accept HTTP/2 over cleartext (h2c) in addition to HTTP/1.1")
+	fs.StringVar(&opts.TLSCert, "tls-cert", "", "PEM certificate chain to serve HTTPS with, requires -tls-key")
+	fs.StringVar(&opts.TLSKey, "tls-key", "", "PEM private key for -tls-cert")
+	fs.StringVar(&opts.HTTPSRedirectAddr, "https-redirect-addr", "", "Address of an extra plain HTTP listener that redirects every request to HTTPS, requires -tls-cert or -acme-domain")
+	fs.Var(&opts.ACMEDomains, "acme-domain", "Domain to obtain a Let's Encrypt certificate for and serve HTTPS with, repeatable or comma-separated")
+	fs.StringVar(&opts.ACMECacheDir, "acme-cache-dir", acmeCacheDir, "Directory ACME account keys and certificates are stored in")
+	fs.StringVar(&opts.ACMEEmail, "acme-email", "", "Contact email registered with the ACME account (optional)")
+	fs.TextVar(logLevel, "log-level", logLevel, "Log level (debug, info, warn, error)")
+	fs.BoolVar(&opts.DebugBodies, "debug-bodies", false, "Log request and response bodies at debug level, with secrets redacted")
+	fs.IntVar(&opts.DebugBodyBytes, "debug-body-bytes", 4096, "Maximum number of body bytes logged by -debug-bodies")
+	fs.Int64Var(&opts.MaxBodyBytes, "max-body-bytes", 0, "Maximum request body size in bytes, 0 for unlimited")
+	fs.IntVar(&opts.BreakerFailures, "breaker-failures", 0, "Consecutive upstream failures that open the circuit breaker, 0 to disable it")
+	fs.DurationVar(&opts.BreakerWindow, "breaker-window", time.Minute, "Window in which -breaker-failures consecutive failures must occur to open the circuit breaker")
+	fs.DurationVar(&opts.BreakerCooldown, "breaker-cooldown", 30*time.Second, "How long an open circuit breaker rejects requests with 503 before probing the upstream again")
+	fs.IntVar(&opts.MaxConcurrent, "max-concurrent", 0, "Maximum number of API requests proxied at once, 0 for unlimited")
+	fs.IntVar(&opts.QueueDepth, "queue-depth", 0, "Number of requests over -max-concurrent that wait for a free slot instead of getting 429")
+	fs.DurationVar(&opts.QueueTimeout, "queue-timeout", 30*time.Second, "Maximum time a request waits in the queue before getting 503, 0 to wait as long as the client does")
+	fs.DurationVar(&opts.SlowRequestThreshold, "slow-request-threshold", 0, "Log proxied requests slower than this at WARN with slow=true; streams are judged by time to first byte, 0 to disable")
+	fs.DurationVar(&opts.SSEKeepalive, "sse-keepalive", 0, "Send an SSE keepalive comment on event streams after this long without upstream data, 0 to disable")
+	fs.Int64Var(&opts.BufferResponseBytes, "buffer-response-bytes", 0, "Buffer non-streaming upstream responses up to this size and send them with Content-Length, 0 to disable")
+	fs.BoolVar(&opts.RestrictMethods, "restrict-methods", false, "Reject API requests whose method is not in -allow-methods with 405")
+	fs.Var(&opts.AllowMethods, "allow-methods", "HTTP methods accepted with -restrict-methods, repeatable or comma-separated (default: GET,POST)")
+	fs.BoolVar(&opts.ValidateJSON, "validate-json", false, "Reject completion and embeddings requests that are not application/json or not well-formed JSON with 400 before they reach the upstream")
+	fs.BoolVar(&opts.AllowUpgrades, "allow-upgrades", false, "Pass Connection: Upgrade requests such as WebSocket through to the upstream instead of rejecting them with 501")
+	fs.Var(&opts.DisableMiddlewares, "disable-middleware", "Middleware to leave out of the API chain, repeatable or comma-separated")
+	fs.StringVar(&opts.AccountsFile, "accounts-file", "", "File with one name:oauth-token GitHub account per line; requests are spread over them and the primary OAuth token")
+	fs.StringVar(&opts.Balance, "balance", copilotproxy.BalanceRoundRobin, "How requests are spread over accounts: round-robin or least-loaded")
+	fs.StringVar(&opts.CopilotUser, "copilot-user", "", "GitHub user whose OAuth token is taken from the credential files when several accounts are logged in (default: the first entry)")
+	fs.BoolVar(&opts.NoAppsJSON, "no-apps-json", false, "Never read the OAuth token from apps.json or other credential files")
+	fs.StringVar(&opts.OTelEndpoint, "otel-endpoint", "", "OTLP/HTTP endpoint URL for exporting traces (default: tracing disabled)")
+	return fs
+}
 
-	for {
-		select {
-		case <-ctx.Done():
+func validateHTTPSURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("invalid URL %q: %w", raw, err)
+	}
+	if u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("invalid URL %q, expected an absolute https URL", raw)
+	}
+	return nil
+}
+
+const envPrefix = "COPILOT_PROXY_"
+
+// envName returns the environment variable overriding a flag, e.g.
+// COPILOT_PROXY_BASE_PATH for -base-path.
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// applyEnv sets every flag not given on the command line from its
+// environment variable, if that is set.
+func applyEnv(fs *flag.FlagSet, lookup func(string) (string, bool)) error {
+	set := setFlags(fs)
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || set[f.Name] {
 			return
-		case <-timeout:
-			timeout = nil
-		case <-retry:
-			retry = nil
-		case <-first:
-			first = nil
-		case <-ticker.C:
 		}
+		if value, ok := lookup(envName(f.Name)); ok {
+			if setErr := fs.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("invalid value %q for %s: %w", value, envName(f.Name), setErr)
+			}
+		}
+	})
+	return err
+}
 
-		if ts.Ready() {
+// applyConfigFile sets every flag not given on the command line or in the
+// environment from a YAML (or JSON) file mapping flag names to values.
+// Lists set repeatable flags once per item.
+func applyConfigFile(fs *flag.FlagSet, file string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	var settings map[string]any
+	if err := yaml.Unmarshal(data, &settings); err != nil {
+		return fmt.Errorf("failed to parse config file %s: %w", file, err)
+	}
+
+	set := setFlags(fs)
+	for key, value := range settings {
+		name := strings.ReplaceAll(key, "_", "-")
+		if fs.Lookup(name) == nil || name == "config" {
+			return fmt.Errorf("%s: unknown setting %q", file, key)
+		}
+		if set[name] {
 			continue
 		}
+		values, ok := value.([]any)
+		if !ok {
+			values = []any{value}
+		}
+		for _, v := range values {
+			switch v.(type) {
+			case map[string]any, []any:
+				return fmt.Errorf("%s: setting %q must be a value or a list of values", file, key)
+			}
+			if err := fs.Set(name, fmt.Sprint(v)); err != nil {
+				return fmt.Errorf("%s: invalid value %v for %q: %w", file, v, key, err)
+			}
+		}
+	}
+	return nil
+}
 
-		var apiToken APIToken
-		if err := ts.refresh(ctx, &apiToken); err != nil {
-			slog.Error("failed to refresh token", "error", err, "retry", 5*time.Second)
-			retry = time.After(5 * time.Second)
-			continue
+func setFlags(fs *flag.FlagSet) map[string]bool {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	return set
+}
+
+// ollamaVersion is the Ollama release /api/version claims to be, for
+// clients that refuse to talk to older servers.
+const ollamaVersion = "0.6.0"
+
+const unixAddrPrefix = "unix://"
+
+// listen listens on a TCP address, or on a Unix domain socket for a
+// unix:// address. A stale socket file left by an earlier run is replaced.
+func listen(addr string, mode os.FileMode) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, unixAddrPrefix)
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	if path == "" {
+		return nil, fmt.Errorf("invalid address %q, missing socket path", addr)
+	}
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode().Type() != os.ModeSocket {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("%s is in use by another process", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket: %w", err)
+		}
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		_ = ln.Close()
+		return nil, fmt.Errorf("failed to set socket mode: %w", err)
+	}
+	return ln, nil
+}
+
+// httpsRedirectHandler redirects to the same host and path over HTTPS on
+// port, or the default port if port is 443.
+func httpsRedirectHandler(port string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if host == "" {
+			http.Error(w, "Missing Host header", http.StatusBadRequest)
+			return
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		target := url.URL{Scheme: "https", Host: host, Path: r.URL.Path, RawPath: r.URL.RawPath, RawQuery: r.URL.RawQuery}
+		http.Redirect(w, r, target.String(), http.StatusPermanentRedirect)
+	})
+}
+
+// defaultCacheDir returns the directory persisted state is kept in by
+// default, or "" if the platform has no cache directory.
+func defaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "copilot-proxy")
+}
+
+const oauthTokenEnv = "COPILOT_OAUTH_TOKEN"
+
+func resolveOAuthToken(value, file string, stdin io.Reader) (token, source string, err error) {
+	if value != "" && value != "-" {
+		return value, "flag", nil
+	}
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", "", fmt.Errorf("failed to read OAuth token file: %w", err)
+		}
+		token = strings.TrimSpace(string(data))
+		if token == "" {
+			return "", "", fmt.Errorf("OAuth token file %s is empty", file)
+		}
+		return token, "file", nil
+	}
+	if value == "-" {
+		data, err := io.ReadAll(stdin)
+		if err != nil {
+			return "", "", fmt.Errorf("failed to read OAuth token from stdin: %w", err)
+		}
+		token = strings.TrimSpace(string(data))
+		if token == "" {
+			return "", "", errors.New("no OAuth token on stdin")
+		}
+		return token, "stdin", nil
+	}
+	if token = strings.TrimSpace(os.Getenv(oauthTokenEnv)); token != "" {
+		return token, "env", nil
+	}
+	return "", "", nil
+}
+
+var credentialFiles = []string{
+	"apps.json",
+	"apps.json.gz",
+	"hosts.json",
+	"hosts.json.gz",
+}
+
+// credentialDirs lists the directories searched for credential files: the
+// platform config directory (XDG_CONFIG_HOME on Linux) and, where that
+// differs, ~/.config, which the Copilot editor plugins use everywhere.
+func credentialDirs() []string {
+	var dirs []string
+	if dir, err := os.UserConfigDir(); err == nil {
+		dirs = append(dirs, filepath.Join(dir, "github-copilot"))
+	}
+	if home := os.Getenv("HOME"); home != "" {
+		dir := filepath.Join(home, ".config", "github-copilot")
+		if !slices.Contains(dirs, dir) {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+func parseOAuthToken(wantUser string) (token, source, user string, err error) {
+	dirs := credentialDirs()
+	if len(dirs) == 0 {
+		return "", "", "", errors.New("cannot locate credential files: neither XDG_CONFIG_HOME nor HOME is set")
+	}
+	var errs []error
+	var tried []string
+	for _, dir := range dirs {
+		for _, name := range credentialFiles {
+			file := filepath.Join(dir, name)
+			tried = append(tried, file)
+			token, user, err := readCredentialFile(file, wantUser)
+			if err == nil {
+				return token, file, user, nil
+			}
+			if !errors.Is(err, os.ErrNotExist) {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if len(errs) == 0 {
+		return "", "", "", fmt.Errorf("no credential file found, tried %s", strings.Join(tried, ", "))
+	}
+	return "", "", "", errors.Join(errs...)
+}
+
+// readCredentialFile returns the OAuth token and user of the first entry in
+// file, or of the entry for wantUser if it is set.
+func readCredentialFile(file, wantUser string) (token, user string, err error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read %s: %w", file, err)
+	}
+	if bytes.HasPrefix(data, []byte{0x1f, 0x8b}) {
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return "", "", fmt.Errorf("failed to decompress %s: %w", file, err)
+		}
+		data, err = io.ReadAll(zr)
+		if err != nil {
+			return "", "", fmt.Errorf("failed to decompress %s: %w", file, err)
 		}
-		slog.Info("token refreshed", "expires_at", time.Unix(apiToken.ExpiresAt, 0), "refresh_in", time.Duration(apiToken.RefreshIn)*time.Second)
+	}
 
-		ts.mu.Lock()
-		ts.apiToken = apiToken
-		ts.mu.Unlock()
+	type TokenObject struct {
+		User       string `json:"user"`
+		OAuthToken string `json:"oauth_token"`
+	}
+	cfg := make(map[string]TokenObject)
+	err = json.Unmarshal(data, &cfg)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to unmarshal %s: %w", file, err)
+	}
 
-		timeout = time.After(time.Duration(apiToken.RefreshIn-10) * time.Second)
+	hosts := make([]string, 0, len(cfg))
+	var users []string
+	for host, obj := range cfg {
+		if obj.OAuthToken == "" {
+			continue
+		}
+		if !slices.Contains(users, obj.User) {
+			users = append(users, obj.User)
+		}
+		if wantUser == "" || obj.User == wantUser {
+			hosts = append(hosts, host)
+		}
 	}
+	// Prefer github.com entries ("github.com" in hosts.json,
+	// "github.com:<client id>" in apps.json) over enterprise hosts.
+	sort.Slice(hosts, func(i, j int) bool {
+		gi, gj := strings.HasPrefix(hosts[i], "github.com"), strings.HasPrefix(hosts[j], "github.com")
+		if gi != gj {
+			return gi
+		}
+		return hosts[i] < hosts[j]
+	})
+	if len(hosts) == 0 && len(users) > 0 {
+		slices.Sort(users)
+		return "", "", fmt.Errorf("no OAuth token for user %q in %s, available users: %s", wantUser, file, strings.Join(users, ", "))
+	}
+	if len(hosts) == 0 {
+		return "", "", fmt.Errorf("no OAuth token found in %s", file)
+	}
+	return cfg[hosts[0]].OAuthToken, cfg[hosts[0]].User, nil
 }
 
-func (ts *TokenSource) refresh(ctx context.Context, apiToken *APIToken) error {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, OAuthTokenEndpoint, nil)
+const (
+	copilotClientID      = "Iv1.b507a08c87ecfe98"
+	githubDeviceCodeURL  = "https://github.com/login/device/code"
+	githubAccessTokenURL = "https://github.com/login/oauth/access_token"
+)
+
+func postForm(ctx context.Context, endpoint string, form url.Values, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
 	if err != nil {
 		return fmt.Errorf("failed to create request: %w", err)
 	}
-	req.Header.Set("Authorization", "Bearer "+ts.oauthToken)
-	req.Header.Set("User-Agent", "vscode-chat/dev")
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 	req.Header.Set("Accept", "application/json")
-
-	rsp, err := ts.client.Do(req)
+	rsp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return fmt.Errorf("failed to refresh token: %w", err)
+		return err
 	}
 	defer rsp.Body.Close()
 
@@ -113,229 +652,935 @@ func (ts *TokenSource) refresh(ctx context.Context, apiToken *APIToken) error {
 	if err != nil {
 		return fmt.Errorf("failed to read response: %w", err)
 	}
+	if rsp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status: %d, body: %s", rsp.StatusCode, string(data))
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+	return nil
+}
+
+// deviceLogin runs the GitHub device authorization flow and returns the
+// OAuth token once the user has approved it in the browser.
+func deviceLogin(ctx context.Context, stdout io.Writer, clientID string) (string, error) {
+	var code struct {
+		DeviceCode      string `json:"device_code"`
+		UserCode        string `json:"user_code"`
+		VerificationURI string `json:"verification_uri"`
+		ExpiresIn       int    `json:"expires_in"`
+		Interval        int    `json:"interval"`
+	}
+	if err := postForm(ctx, githubDeviceCodeURL, url.Values{"client_id": {clientID}, "scope": {"read:user"}}, &code); err != nil {
+		return "", fmt.Errorf("failed to request device code: %w", err)
+	}
+	fmt.Fprintf(stdout, "Open %s and enter the code %s\n", code.VerificationURI, code.UserCode)
+
+	interval := time.Duration(max(code.Interval, 5)) * time.Second
+	deadline := time.Now().Add(time.Duration(code.ExpiresIn) * time.Second)
+	for time.Now().Before(deadline) {
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(interval):
+		}
+
+		var token struct {
+			AccessToken string `json:"access_token"`
+			Error       string `json:"error"`
+			Description string `json:"error_description"`
+		}
+		form := url.Values{
+			"client_id":   {clientID},
+			"device_code": {code.DeviceCode},
+			"grant_type":  {"urn:ietf:params:oauth:grant-type:device_code"},
+		}
+		if err := postForm(ctx, githubAccessTokenURL, form, &token); err != nil {
+			return "", fmt.Errorf("failed to poll for access token: %w", err)
+		}
+		switch token.Error {
+		case "":
+			if token.AccessToken == "" {
+				return "", errors.New("GitHub returned no access token")
+			}
+			return token.AccessToken, nil
+		case "authorization_pending":
+		case "slow_down":
+			interval += 5 * time.Second
+		default:
+			return "", fmt.Errorf("device login failed: %s: %s", token.Error, token.Description)
+		}
+	}
+	return "", errors.New("device code expired before it was approved")
+}
+
+func githubLogin(ctx context.Context, token string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, copilotproxy.GitHubAPIEndpoint+"/user", nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Accept", "application/json")
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer rsp.Body.Close()
 
 	if rsp.StatusCode != http.StatusOK {
-		return fmt.Errorf("failed to refresh token: status: %d, body: %s", rsp.StatusCode, string(data))
+		data, _ := io.ReadAll(io.LimitReader(rsp.Body, 4096))
+		return "", fmt.Errorf("status: %d, body: %s", rsp.StatusCode, string(data))
 	}
+	var user struct {
+		Login string `json:"login"`
+	}
+	if err := json.NewDecoder(rsp.Body).Decode(&user); err != nil {
+		return "", fmt.Errorf("failed to decode user: %w", err)
+	}
+	return user.Login, nil
+}
 
-	if err = json.Unmarshal(data, apiToken); err != nil {
-		return fmt.Errorf("failed to unmarshal token: %w", err)
+// writeAppsJSON adds or replaces the entry for clientID in an apps.json
+// file, keeping any other accounts in it.
+func writeAppsJSON(file, clientID, user, token string) error {
+	apps := make(map[string]map[string]any)
+	data, err := os.ReadFile(file)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, &apps); err != nil {
+			return fmt.Errorf("failed to unmarshal %s: %w", file, err)
+		}
+	case !errors.Is(err, os.ErrNotExist):
+		return fmt.Errorf("failed to read %s: %w", file, err)
+	}
+	apps["github.com:"+clientID] = map[string]any{
+		"user":        user,
+		"oauth_token": token,
+		"githubAppId": clientID,
 	}
 
+	data, err = json.MarshalIndent(apps, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s: %w", file, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0o700); err != nil {
+		return fmt.Errorf("failed to create %s: %w", filepath.Dir(file), err)
+	}
+	if err := os.WriteFile(file, data, 0o600); err != nil {
+		return fmt.Errorf("failed to write %s: %w", file, err)
+	}
 	return nil
 }
 
-func (ts *TokenSource) Ready() bool {
-	ts.mu.RLock()
-	defer ts.mu.RUnlock()
+func runLogin(ctx context.Context, args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("copilot-proxy login", flag.ContinueOnError)
+	output := fs.String("output", "", "apps.json file to write the OAuth token to (default: apps.json in the first credential directory)")
+	clientID := fs.String("client-id", copilotClientID, "GitHub OAuth app client ID used for the device flow")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return fmt.Errorf("%w: %w", errUsage, err)
+	}
+
+	file := *output
+	if file == "" {
+		dirs := credentialDirs()
+		if len(dirs) == 0 {
+			return errors.New("cannot locate the credential directory: neither XDG_CONFIG_HOME nor HOME is set, use -output")
+		}
+		file = filepath.Join(dirs[0], "apps.json")
+	}
 
-	return ts.ready()
+	token, err := deviceLogin(ctx, stdout, *clientID)
+	if err != nil {
+		return err
+	}
+	user, err := githubLogin(ctx, token)
+	if err != nil {
+		return fmt.Errorf("failed to look up the GitHub user: %w", err)
+	}
+	if err := writeAppsJSON(file, *clientID, user, token); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "Logged in as %s, OAuth token written to %s\n", user, file)
+	return nil
 }
 
-func (ts *TokenSource) ready() bool {
-	return ts.apiToken.ExpiresAt > time.Now().Unix()
+func parseOptions(args []string, logLevel *slog.LevelVar) (*options, *flag.FlagSet, error) {
+	var opts options
+	fs := newFlagSet(&opts, logLevel)
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil, nil, err
+		}
+		return nil, nil, fmt.Errorf("%w: %w", errUsage, err)
+	}
+	if err := applyEnv(fs, os.LookupEnv); err != nil {
+		return nil, nil, err
+	}
+	if opts.Config != "" {
+		if err := applyConfigFile(fs, opts.Config); err != nil {
+			return nil, nil, err
+		}
+	}
+	return &opts, fs, nil
 }
 
-func (ts *TokenSource) Token() string {
-	ts.mu.RLock()
-	defer ts.mu.RUnlock()
+func flagValues(fs *flag.FlagSet) map[string]string {
+	values := make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		values[f.Name] = f.Value.String()
+	})
+	return values
+}
 
-	return ts.apiToken.Token
+func loadAccessKeys(opts *options) ([]*copilotproxy.AccessKey, error) {
+	var keys []*copilotproxy.AccessKey
+	if opts.AccessToken != "" {
+		keys = append(keys, &copilotproxy.AccessKey{Name: "default", Token: opts.AccessToken})
+	}
+	if opts.AccessTokensFile != "" {
+		fileKeys, err := copilotproxy.ParseAccessTokensFile(opts.AccessTokensFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load access tokens: %w", err)
+		}
+		keys = append(keys, fileKeys...)
+	}
+	for _, value := range opts.AccessKeys {
+		key, err := copilotproxy.ParseAccessKey(value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load access tokens: -access-key: %w", err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
 }
 
-func (ts *TokenSource) CustomHeaders(header http.Header) {
-	header.Set("Authorization", "Bearer "+ts.Token())
-	header.Set("User-Agent", "vscode-chat/dev")
-	header.Set("Copilot-Integration-Id", "vscode-chat")
-	header.Set("Editor-Version", "Neovim/0.11.0")
-	header.Set("Editor-Plugin-Version", "copilot-chat/0.1.0")
+// reloadableFlags are the settings reload applies to a running proxy.
+var reloadableFlags = map[string]bool{
+	"access-token":       true,
+	"access-tokens-file": true,
+	"access-key":         true,
+	"models-file":        true,
 }
 
-func (ts *TokenSource) NewProxy(upstream *url.URL) http.Handler {
-	proxy := &httputil.ReverseProxy{
-		Rewrite: func(r *httputil.ProxyRequest) {
-			r.SetURL(upstream)
-			ts.CustomHeaders(r.Out.Header)
-		},
+// reload re-reads the command line, environment and config file and swaps
+// in the access tokens and the -models-file list. Any other setting that
+// changed since startup, including the upstreams, is only logged, as it
+// takes a restart to apply.
+func reload(args []string, initial map[string]string, accessKeys *copilotproxy.AccessKeys, models *copilotproxy.ModelsBody) error {
+	opts, fs, err := parseOptions(args, new(slog.LevelVar))
+	if err != nil {
+		return err
+	}
+	keys, err := loadAccessKeys(opts)
+	if err != nil {
+		return err
+	}
+	var modelsList []byte
+	if opts.ModelsFile != "" {
+		modelsList, err = copilotproxy.ParseModelsFile(opts.ModelsFile)
+		if err != nil {
+			return err
+		}
+	}
+	if err := accessKeys.Replace(keys...); err != nil {
+		return fmt.Errorf("failed to load access tokens: %w", err)
+	}
+	models.Store(modelsList)
+	slog.Info("reloaded access tokens", "tokens", len(keys))
+	if opts.ModelsFile != "" {
+		slog.Info("reloaded static models list", "file", opts.ModelsFile)
 	}
 
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if !ts.Ready() {
-			http.Error(w, "Service not ready", http.StatusServiceUnavailable)
-			return
+	var changed []string
+	for name, value := range flagValues(fs) {
+		if !reloadableFlags[name] && value != initial[name] {
+			changed = append(changed, name)
 		}
-		tracker := TrackStatusCode(w)
-		start := time.Now()
+	}
+	if len(changed) > 0 {
+		sort.Strings(changed)
+		slog.Warn("changed settings take effect after a restart", "flags", changed)
+	}
+	return nil
+}
 
-		defer func() {
-			slog.Info("proxied request", "method", r.Method, "url", r.URL.String(), "duration", time.Since(start).String(), "status", tracker.code, "name", "accesslog")
-		}()
+func runCheck(ctx context.Context, stdout io.Writer, ts *copilotproxy.TokenSource, upstream *url.URL, models bool) error {
+	start := time.Now()
+	if err := ts.RefreshNow(ctx); err != nil {
+		return fmt.Errorf("token refresh: %w", err)
+	}
+	fmt.Fprintf(stdout, "token refresh: ok (%s), expires at %s\n", time.Since(start).Round(time.Millisecond), ts.ExpiresAt().Format(time.RFC3339))
 
-		proxy.ServeHTTP(tracker, r)
-	})
-}
+	if !models {
+		return nil
+	}
 
-func (ts *TokenSource) NewGitHubAPIProxy(upstream *url.URL) http.Handler {
-	proxy := &httputil.ReverseProxy{
-		Rewrite: func(r *httputil.ProxyRequest) {
-			r.SetURL(upstream)
-			r.Out.Header.Set("Authorization", "Bearer "+ts.oauthToken)
-			r.Out.Header.Set("User-Agent", "vscode-chat/dev")
-			r.Out.Header.Set("Accept", "application/json")
-		},
+	start = time.Now()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, upstream.JoinPath("models").String(), nil)
+	if err != nil {
+		return fmt.Errorf("models: failed to create request: %w", err)
 	}
+	ts.CustomHeaders(req.Header)
 
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		tracker := TrackStatusCode(w)
-		start := time.Now()
+	rsp, err := ts.Client().Do(req)
+	if err != nil {
+		return fmt.Errorf("models: %w", err)
+	}
+	defer rsp.Body.Close()
 
-		defer func() {
-			slog.Info("proxied request", "method", r.Method, "url", r.URL.String(), "duration", time.Since(start).String(), "status", tracker.code, "name", "accesslog")
-		}()
+	var list struct {
+		Data []json.RawMessage `json:"data"`
+	}
+	if rsp.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(io.LimitReader(rsp.Body, 4096))
+		return fmt.Errorf("models: status: %d, body: %s", rsp.StatusCode, string(data))
+	}
+	if err := json.NewDecoder(rsp.Body).Decode(&list); err != nil {
+		return fmt.Errorf("models: failed to decode response: %w", err)
+	}
+	fmt.Fprintf(stdout, "models: ok (%s), %d models available from %s\n", time.Since(start).Round(time.Millisecond), len(list.Data), upstream.Host)
 
-		proxy.ServeHTTP(tracker, r)
-	})
+	return nil
 }
 
-var Args struct {
-	OAuthToken  string
-	AccessToken string
-	Addr        string
-	BasePath    string
+var secretFlags = map[string]bool{
+	"oauth-token":   true,
+	"access-token":  true,
+	"basic-auth":    true,
+	"access-key":    true,
+	"token-header":  true,
+	"alert-webhook": true,
 }
 
-func init() {
-	flag.StringVar(&Args.OAuthToken, "oauth-token", "", "OAuth token for GitHub API")
-	flag.StringVar(&Args.Addr, "addr", ":8080", "Address to listen on")
-	flag.StringVar(&Args.AccessToken, "access-token", "", "Access token for OpenAI API")
-	flag.StringVar(&Args.BasePath, "base-path", "/api/v1", "Base path for the API")
+func maskSecret(value string) string {
+	if value == "" {
+		return ""
+	}
+	if len(value) <= 8 {
+		return "****"
+	}
+	return value[:4] + "****"
 }
 
-type Middleware func(http.Handler) http.Handler
-
-func applyMiddlewares(handler http.Handler, middlewares ...Middleware) http.Handler {
-	for i := len(middlewares) - 1; i >= 0; i-- {
-		handler = middlewares[i](handler)
+func maskFlag(f *flag.Flag) string {
+	if creds, ok := f.Value.(*credentialList); ok {
+		return creds.masked()
 	}
-	return handler
+	value := f.Value.String()
+	switch f.Name {
+	case "token-header":
+		headers := strings.Split(value, ",")
+		for i, header := range headers {
+			if key, _, ok := strings.Cut(header, "="); ok {
+				headers[i] = key + "=****"
+			}
+		}
+		return strings.Join(headers, ",")
+	}
+	return maskSecret(value)
 }
 
-func stripPrefix(prefix string) Middleware {
-	return func(next http.Handler) http.Handler {
-		return http.StripPrefix(prefix, next)
-	}
+type flagConfig struct {
+	Value   string `json:"value"`
+	Default string `json:"default"`
+	Set     bool   `json:"set"`
 }
 
-func verifyAccessToken(token string) Middleware {
-	return func(next http.Handler) http.Handler {
-		if token == "" {
-			return next
-		}
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			authHeader := r.Header.Get("Authorization")
-			if authHeader != "Bearer "+token {
-				http.Error(w, "Invalid access token", http.StatusUnauthorized)
-				return
+func configHandler(fs *flag.FlagSet, oauthSource string, upstreams []*url.URL, listenAddr func() string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		set := setFlags(fs)
+		flags := make(map[string]flagConfig)
+		fs.VisitAll(func(f *flag.Flag) {
+			value := f.Value.String()
+			if secretFlags[f.Name] {
+				value = maskFlag(f)
 			}
+			flags[f.Name] = flagConfig{Value: value, Default: f.DefValue, Set: set[f.Name]}
+		})
 
-			next.ServeHTTP(w, r)
+		resolved := make([]string, 0, len(upstreams))
+		for _, upstream := range upstreams {
+			resolved = append(resolved, upstream.String())
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"version":            version,
+			"flags":              flags,
+			"oauth_token_source": oauthSource,
+			"upstreams":          resolved,
+			"listen_addr":        listenAddr(),
 		})
 	}
 }
 
-type StatusCodeTracker struct {
-	http.ResponseWriter
-
-	code int
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]string{
+		"version":    version,
+		"commit":     commit,
+		"build_date": buildDate,
+	})
 }
 
-func TrackStatusCode(w http.ResponseWriter) *StatusCodeTracker {
-	return &StatusCodeTracker{ResponseWriter: w, code: 0}
-}
+var errCheckFailed = errors.New("check failed")
 
-func (s *StatusCodeTracker) WriteHeader(code int) {
-	if s.code != 0 {
-		return
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		// Restore the default signal handling once shutdown begins, so a
+		// second signal kills the process.
+		<-ctx.Done()
+		stop()
+	}()
+
+	if err := run(ctx, os.Args[1:], os.Stdout); err != nil {
+		switch {
+		case errors.Is(err, errUsage):
+			os.Exit(2)
+		case !errors.Is(err, errCheckFailed):
+			slog.Error("copilot-proxy failed", "error", err)
+		}
+
+		os.Exit(1)
 	}
-	s.code = code
-	s.ResponseWriter.WriteHeader(code)
 }
 
-func (s *StatusCodeTracker) Write(b []byte) (int, error) {
-	if s.code == 0 {
-		s.code = http.StatusOK
+var errUsage = errors.New("invalid usage")
+
+// run starts the proxy with the given command line arguments, without the
+// program name, and serves until ctx is done. Logs go to stdout.
+func run(ctx context.Context, args []string, stdout io.Writer) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var logLevel slog.LevelVar
+	slog.SetDefault(slog.New(slog.NewJSONHandler(stdout, &slog.HandlerOptions{
+		AddSource: true,
+		Level:     &logLevel,
+	})))
+
+	if len(args) > 0 && args[0] == "login" {
+		return runLogin(ctx, args[1:], stdout)
 	}
-	return s.ResponseWriter.Write(b)
-}
 
-func (s *StatusCodeTracker) Unwrap() http.ResponseWriter {
-	return s.ResponseWriter
-}
+	opts, fs, err := parseOptions(args, &logLevel)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+	initialFlags := flagValues(fs)
 
-func parseOAuthToken() (string, error) {
-	apps := filepath.Join(os.Getenv("HOME"), ".config/github-copilot/apps.json")
-	data, err := os.ReadFile(apps)
+	slog.Info("starting copilot-proxy", "version", version, "commit", commit, "build_date", buildDate)
+
+	if opts.DebugBodies && !slog.Default().Enabled(context.Background(), slog.LevelDebug) {
+		slog.Warn("-debug-bodies has no effect unless -log-level is debug")
+	}
+
+	basicCreds, err := copilotproxy.ParseBasicCredentials(opts.BasicAuth)
 	if err != nil {
-		return "", fmt.Errorf("failed to read apps.json: %w", err)
+		return fmt.Errorf("failed to parse basic auth credentials: %w", err)
 	}
-	type TokenObject struct {
-		User       string `json:"user"`
-		OAuthToken string `json:"oauth_token"`
+
+	keys, err := loadAccessKeys(opts)
+	if err != nil {
+		return err
 	}
-	cfg := make(map[string]TokenObject)
-	err = json.Unmarshal(data, &cfg)
+	accessKeys, err := copilotproxy.NewAccessKeys(keys...)
 	if err != nil {
-		return "", fmt.Errorf("failed to unmarshal apps.json: %w", err)
+		return fmt.Errorf("failed to load access tokens: %w", err)
 	}
-	for _, obj := range cfg {
-		return obj.OAuthToken, nil
+
+	if accessKeys.Len() == 0 && len(basicCreds) == 0 {
+		if opts.RequireAuth {
+			return errors.New("access token is missing and -require-auth is set")
+		}
+		slog.Warn("access token is missing")
 	}
-	return "", fmt.Errorf("no OAuth token found in apps.json")
-}
 
-func main() {
-	flag.Parse()
+	oauthToken, source, err := resolveOAuthToken(opts.OAuthToken, opts.OAuthTokenFile, os.Stdin)
+	if err != nil {
+		return fmt.Errorf("failed to read OAuth token: %w", err)
+	}
+	if oauthToken != "" {
+		slog.Info("using OAuth token", "source", source)
+	}
+	opts.OAuthToken = oauthToken
+	primaryAccount := "default"
 
-	if Args.AccessToken == "" {
-		slog.Warn("access token is missing")
+	if opts.OAuthToken == "" && opts.NoAppsJSON {
+		return errors.New("no OAuth token provided and reading credential files is disabled by -no-apps-json")
 	}
 
-	if Args.OAuthToken == "" {
-		slog.Info("no OAuth token provided, trying to read from apps.json")
+	if opts.OAuthToken == "" {
+		slog.Info("no OAuth token provided, trying to read from credential files")
 
-		oauthToken, err := parseOAuthToken()
+		oauthToken, file, user, err := parseOAuthToken(opts.CopilotUser)
 		if err != nil {
-			slog.Error("failed to read OAuth token from apps.json", "error", err)
+			return fmt.Errorf("failed to read OAuth token from credential files: %w", err)
+		}
+		slog.Info("using OAuth token", "source", file, "user", user)
 
-			os.Exit(1)
+		opts.OAuthToken = oauthToken
+		source = file
+		if user != "" {
+			primaryAccount = user
 		}
+	}
 
-		Args.OAuthToken = oauthToken
+	if err := validateHTTPSURL(opts.APIEndpoint); err != nil {
+		return fmt.Errorf("invalid -api-endpoint: %w", err)
+	}
+	if err := validateHTTPSURL(opts.TokenEndpoint); err != nil {
+		return fmt.Errorf("invalid -token-endpoint: %w", err)
+	}
+
+	allowedPrefixes, err := copilotproxy.ParseCIDRs(opts.AllowCIDRs)
+	if err != nil {
+		return fmt.Errorf("failed to parse allowed CIDRs: %w", err)
+	}
+
+	var modelsList []byte
+	if opts.ModelsFile != "" {
+		modelsList, err = copilotproxy.ParseModelsFile(opts.ModelsFile)
+		if err != nil {
+			return err
+		}
+		slog.Info("serving static models list", "file", opts.ModelsFile)
+	}
+	models := copilotproxy.NewModelsBody(modelsList)
+
+	var embeddingsCache *copilotproxy.ResponseCache
+	if opts.EmbeddingsCacheSize > 0 {
+		embeddingsCache = copilotproxy.NewResponseCache(opts.EmbeddingsCacheSize, opts.EmbeddingsCacheTTL)
+		slog.Info("embeddings cache enabled", "size", opts.EmbeddingsCacheSize, "ttl", opts.EmbeddingsCacheTTL)
+	}
+
+	var usage *copilotproxy.UsageStore
+	if opts.UsageDB != "" {
+		usage, err = copilotproxy.OpenUsageStore(opts.UsageDB)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := usage.Close(); err != nil {
+				slog.Warn("failed to close usage database", "error", err)
+			}
+		}()
+		slog.Info("usage accounting enabled", "file", opts.UsageDB)
 	}
 
-	ts := NewTokenSource(Args.OAuthToken)
+	budget := copilotproxy.NewRequestBudget(opts.MaxRequests)
+	if opts.MaxRequests > 0 {
+		slog.Info("request limit enabled", "max_requests", opts.MaxRequests)
+	}
 
-	upstream, _ := url.Parse(APIEndpoint)
-	proxy := ts.NewProxy(upstream)
+	if opts.KeyDailyTokens < 0 || opts.KeyMonthlyTokens < 0 {
+		return fmt.Errorf("invalid token quota, expected -key-daily-tokens and -key-monthly-tokens >= 0")
+	}
+	keyQuotas, err := copilotproxy.ParseQuotas(opts.KeyQuotas)
+	if err != nil {
+		return err
+	}
+	quotas := copilotproxy.NewQuotas(usage, copilotproxy.Quota{Daily: opts.KeyDailyTokens, Monthly: opts.KeyMonthlyTokens}, keyQuotas)
+	if quotas.Enabled() {
+		if usage == nil {
+			return fmt.Errorf("token quotas require -usage-db")
+		}
+		if err := quotas.Load(ctx); err != nil {
+			return fmt.Errorf("failed to load token quota usage: %w", err)
+		}
+		slog.Info("token quotas enabled", "daily", opts.KeyDailyTokens, "monthly", opts.KeyMonthlyTokens, "overrides", len(keyQuotas))
+	}
 
-	ctx := context.Background()
-	go ts.Start(ctx)
+	if opts.KeyRequestsPerMinute < 0 || opts.KeyTokensPerMinute < 0 {
+		return fmt.Errorf("invalid per access token rate limit, expected -key-requests-per-minute and -key-tokens-per-minute >= 0")
+	}
+	keyLimiter := copilotproxy.NewKeyRateLimiter(opts.KeyRequestsPerMinute, opts.KeyTokensPerMinute)
+	if opts.KeyRequestsPerMinute > 0 || opts.KeyTokensPerMinute > 0 {
+		slog.Info("per access token rate limit enabled", "requests_per_minute", opts.KeyRequestsPerMinute, "tokens_per_minute", opts.KeyTokensPerMinute)
+	}
+
+	if opts.BreakerFailures < 0 || opts.BreakerWindow <= 0 || opts.BreakerCooldown <= 0 {
+		return fmt.Errorf("invalid circuit breaker settings, expected -breaker-failures >= 0 and positive -breaker-window and -breaker-cooldown")
+	}
+	var breaker *copilotproxy.CircuitBreaker
+	if opts.BreakerFailures > 0 {
+		breaker = copilotproxy.NewCircuitBreaker(opts.BreakerFailures, opts.BreakerWindow, opts.BreakerCooldown)
+		gauge := copilotproxy.NewGaugeFunc("copilot_proxy_circuit_breaker_state", "State of the upstream circuit breaker: 0 closed, 1 open, 2 half-open.", func() float64 {
+			return float64(breaker.State())
+		})
+		defer gauge.Unregister()
+		slog.Info("circuit breaker enabled", "failures", opts.BreakerFailures, "window", opts.BreakerWindow, "cooldown", opts.BreakerCooldown)
+	}
+
+	var limiter *copilotproxy.ConcurrencyLimiter
+	if opts.MaxConcurrent > 0 {
+		limiter = copilotproxy.NewConcurrencyLimiter(opts.MaxConcurrent, opts.QueueDepth, opts.QueueTimeout)
+		gauge := copilotproxy.NewGaugeFunc("copilot_proxy_queued_requests", "Number of requests waiting for a concurrency slot.", func() float64 {
+			return float64(limiter.Queued())
+		})
+		defer gauge.Unregister()
+		slog.Info("concurrency limit enabled", "max_concurrent", opts.MaxConcurrent, "queue_depth", opts.QueueDepth, "queue_timeout", opts.QueueTimeout)
+	}
+
+	var shuttingDown atomic.Bool
+
+	ts := copilotproxy.NewTokenSource(opts.OAuthToken)
+	if opts.RefreshLead < 0 {
+		return fmt.Errorf("invalid refresh lead time %s", opts.RefreshLead)
+	}
+	if opts.MaxTokenAge < 0 || (opts.MaxTokenAge > 0 && opts.MaxTokenAge <= opts.RefreshLead) {
+		return fmt.Errorf("invalid max token age %s, expected 0 or a value greater than -refresh-lead (%s)", opts.MaxTokenAge, opts.RefreshLead)
+	}
+	if opts.PrefetchLead < 0 {
+		return fmt.Errorf("invalid prefetch lead time %s", opts.PrefetchLead)
+	}
+	if opts.AccessLogSample < 0 || opts.AccessLogSample > 1 {
+		return fmt.Errorf("invalid access log sample rate %v, expected a value between 0 and 1", opts.AccessLogSample)
+	}
+	ts.AccessLogSample = opts.AccessLogSample
+	ts.RefreshLead = opts.RefreshLead
+	ts.RefreshTimeout = opts.RefreshTimeout
+	ts.ExpiryGrace = opts.ExpiryGrace
+	ts.TokenEndpoint = opts.TokenEndpoint
+	ts.StopOnAuthError = opts.FatalOnAuth
+	ts.MaxTokenAge = opts.MaxTokenAge
+	ts.PrefetchLead = opts.PrefetchLead
+	if !opts.NoTokenCache {
+		ts.CacheDir = opts.TokenCacheDir
+	}
+	if opts.AlertWebhook != "" {
+		if err := validateHTTPSURL(opts.AlertWebhook); err != nil {
+			return fmt.Errorf("invalid -alert-webhook: %w", err)
+		}
+		alerts := copilotproxy.NewAlertWebhook(opts.AlertWebhook)
+		alerts.Threshold = opts.AlertAfter
+		alerts.Debounce = opts.AlertDebounce
+		ts.OnRefreshError = alerts.RefreshFailed
+		ts.OnRefreshSuccess = alerts.RefreshSucceeded
+		ts.OnReadinessChange = alerts.ReadinessChanged
+	}
+	ts.AuthScheme = opts.TokenAuthScheme
+	ts.IntegrationID = opts.IntegrationID
+	ts.BufferResponseBytes = opts.BufferResponseBytes
+	ts.SlowRequestThreshold = opts.SlowRequestThreshold
+	ts.SSEKeepalive = opts.SSEKeepalive
+	ts.AllowedIntegrationIDs = opts.IntegrationIDs
+	ts.DefaultModel = opts.DefaultModel
+	for key, values := range opts.TokenHeaders {
+		switch key {
+		case "User-Agent":
+			ts.UserAgent = values[0]
+		case "Accept":
+			ts.Accept = values[0]
+		default:
+			ts.ExtraHeaders[key] = values
+		}
+	}
+
+	tracing := opts.OTelEndpoint != ""
+	if tracing {
+		shutdown, err := copilotproxy.SetupTracing(ctx, opts.OTelEndpoint)
+		if err != nil {
+			return fmt.Errorf("failed to set up tracing: %w", err)
+		}
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			_ = shutdown(ctx)
+		}()
+
+		slog.Info("tracing enabled", "endpoint", opts.OTelEndpoint)
+	}
+
+	upstreamTransport, err := copilotproxy.NewUpstreamTransport(copilotproxy.TransportOptions{
+		MaxIdleConns:          opts.MaxIdleConns,
+		MaxIdleConnsPerHost:   opts.MaxIdleConnsPerHost,
+		IdleConnTimeout:       opts.IdleConnTimeout,
+		ResponseHeaderTimeout: opts.ResponseHeaderTimeout,
+		CAFile:                opts.UpstreamCA,
+		InsecureSkipVerify:    opts.InsecureSkipVerify,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create upstream transport: %w", err)
+	}
+	if opts.InsecureSkipVerify {
+		slog.Warn("TLS certificate verification is DISABLED for upstream connections, do not use this in production")
+	}
+
+	var transport http.RoundTripper = upstreamTransport
+	if tracing {
+		transport = otelhttp.NewTransport(transport)
+	}
+	ts.SetTransport(transport)
+
+	if opts.UpstreamRetries < 0 || opts.UpstreamRetryBackoff < 0 || opts.UpstreamRetryBudget < 0 {
+		return fmt.Errorf("invalid upstream retry settings, expected -upstream-retries, -upstream-retry-backoff and -upstream-retry-budget >= 0")
+	}
+	if opts.UpstreamRetries > 0 {
+		ts.Retry = copilotproxy.RetryPolicy{Max: opts.UpstreamRetries, Backoff: opts.UpstreamRetryBackoff}
+		if opts.UpstreamRetryBudget > 0 {
+			ts.Retry.Budget = copilotproxy.NewRetryBudget(opts.UpstreamRetryBudget)
+		}
+		slog.Info("upstream retries enabled", "max", opts.UpstreamRetries, "backoff", opts.UpstreamRetryBackoff, "budget", opts.UpstreamRetryBudget)
+	}
+
+	entitlement := copilotproxy.NewEntitlementMonitor(opts.DegradeOnEntitlementError)
+	ts.ResponseHooks = append(ts.ResponseHooks, entitlement.Hook)
+	onRefreshSuccess := ts.OnRefreshSuccess
+	ts.OnRefreshSuccess = func() {
+		entitlement.Recover()
+		if onRefreshSuccess != nil {
+			onRefreshSuccess()
+		}
+	}
+
+	remaps, err := copilotproxy.ParseStatusRemaps(opts.RemapStatus)
+	if err != nil {
+		return fmt.Errorf("failed to parse status remaps: %w", err)
+	}
+	if len(remaps) > 0 {
+		ts.ResponseHooks = append(ts.ResponseHooks, copilotproxy.RemapStatus(remaps))
+	}
+
+	if len(opts.StripResponseHeaders) > 0 || len(opts.AddResponseHeaders) > 0 {
+		ts.ResponseHooks = append(ts.ResponseHooks, copilotproxy.RewriteResponseHeaders(opts.StripResponseHeaders, http.Header(opts.AddResponseHeaders)))
+	}
+
+	if len(opts.Upstreams) == 0 {
+		opts.Upstreams = stringSlice{opts.APIEndpoint}
+	}
+	upstreams := make([]*url.URL, 0, len(opts.Upstreams))
+	for _, raw := range opts.Upstreams {
+		upstream, err := url.Parse(raw)
+		if err != nil || upstream.Scheme == "" || upstream.Host == "" {
+			return fmt.Errorf("invalid upstream URL %q: %v", raw, err)
+		}
+		upstreams = append(upstreams, upstream)
+	}
+	for _, raw := range opts.AllowUpstreams {
+		upstream, err := url.Parse(raw)
+		if err != nil || upstream.Scheme == "" || upstream.Host == "" {
+			return fmt.Errorf("invalid -allow-upstream URL %q: %v", raw, err)
+		}
+		ts.AllowedUpstreams = append(ts.AllowedUpstreams, upstream)
+	}
+	accounts := []*copilotproxy.Account{{Name: primaryAccount, Source: ts}}
+	if opts.AccountsFile != "" {
+		creds, err := copilotproxy.ParseAccountsFile(opts.AccountsFile)
+		if err != nil {
+			return err
+		}
+		for _, cred := range creds {
+			accounts = append(accounts, &copilotproxy.Account{Name: cred.Name, Source: ts.WithOAuthToken(cred.OAuthToken)})
+		}
+	}
+	pool, err := copilotproxy.NewAccountPool(opts.Balance, accounts...)
+	if err != nil {
+		return fmt.Errorf("failed to set up accounts: %w", err)
+	}
+	if len(accounts) > 1 {
+		names := make([]string, 0, len(accounts))
+		for _, account := range accounts {
+			names = append(names, account.Name)
+		}
+		slog.Info("load balancing over accounts", "accounts", names, "balance", opts.Balance)
+	}
+	proxy := pool.NewProxy(upstreams...)
+
+	if opts.Check {
+		if err := runCheck(ctx, stdout, ts, upstreams[0], opts.CheckModels); err != nil {
+			fmt.Fprintf(stdout, "check failed: %v\n", err)
+			return errCheckFailed
+		}
+		fmt.Fprintln(stdout, "check passed")
+		return nil
+	}
+
+	for _, account := range accounts {
+		if _, err := account.Source.LoadCachedToken(); err != nil {
+			slog.Warn("failed to load cached token", "account", account.Name, "error", err)
+		}
+	}
+
+	if opts.WaitReady {
+		if opts.StartupJitter > 0 {
+			slog.Warn("-startup-jitter is ignored with -wait-ready")
+		}
+		for _, account := range accounts {
+			if account.Source.Ready() {
+				continue
+			}
+			if err := account.Source.RefreshNow(ctx); err != nil {
+				if copilotproxy.RefreshErrorKindOf(err) == copilotproxy.RefreshErrorAuth {
+					return fmt.Errorf("account %s: %w", account.Name, err)
+				}
+				slog.Warn("initial token refresh failed, will keep retrying", "account", account.Name, "error", err, "kind", copilotproxy.RefreshErrorKindOf(err).String())
+			}
+		}
+	} else {
+		for _, account := range accounts {
+			account.Source.StartupJitter = opts.StartupJitter
+		}
+	}
+
+	// The refresh loops outlive ctx so that requests still draining on
+	// shutdown keep a valid token; they are stopped once the server is done.
+	refreshCtx, stopRefresh := context.WithCancel(context.WithoutCancel(ctx))
+	var refreshing sync.WaitGroup
+	defer func() {
+		stopRefresh()
+		refreshing.Wait()
+	}()
+
+	fatal := make(chan error, 1)
+	for _, account := range accounts {
+		refreshing.Add(1)
+		go func() {
+			defer refreshing.Done()
+			if err := account.Source.Start(refreshCtx); err != nil {
+				select {
+				case fatal <- fmt.Errorf("stopping, -fatal-on-auth is set: account %s: %w", account.Name, err):
+				default:
+				}
+			}
+		}()
+	}
 
 	mux := http.NewServeMux()
 
-	middlewares := []Middleware{
-		stripPrefix(Args.BasePath),
-		verifyAccessToken(Args.AccessToken),
+	auth := copilotproxy.VerifyAccessToken(accessKeys, basicCreds)
+
+	allowPaths, err := copilotproxy.ParsePathRules(opts.AllowPaths)
+	if err != nil {
+		return fmt.Errorf("failed to parse allowed paths: %w", err)
+	}
+	denyPaths, err := copilotproxy.ParsePathRules(opts.DenyPaths)
+	if err != nil {
+		return fmt.Errorf("failed to parse denied paths: %w", err)
+	}
+
+	var allowMethods []string
+	if opts.RestrictMethods {
+		allowMethods = opts.AllowMethods
+		if len(allowMethods) == 0 {
+			allowMethods = []string{http.MethodGet, http.MethodPost}
+		}
+	}
+
+	// Order matters: recovery wraps everything, the request ID is assigned
+	// before anything logs, auth runs before the request budget is charged,
+	// requests the method and path filters reject never reach the per-key
+	// limits and the body limit applies before anything reads the body.
+	middlewares, chain, err := copilotproxy.BuildChain([]copilotproxy.ChainEntry{
+		{Name: "recover", Middleware: copilotproxy.RecoverPanics},
+		{Name: "request-id", Middleware: copilotproxy.RequestID},
+		{Name: "trace", Middleware: copilotproxy.TraceRequests(tracing, "copilot-api")},
+		{Name: "request-info", Middleware: copilotproxy.TrackRequestInfo, Required: true},
+		{Name: "strip-prefix", Middleware: copilotproxy.StripPrefix(opts.BasePath), Required: true},
+		{Name: "auth", Middleware: auth, Required: true},
+		{Name: "reject-upgrades", Middleware: copilotproxy.RejectUpgrades(opts.AllowUpgrades)},
+		{Name: "restrict-methods", Middleware: copilotproxy.RestrictMethods(allowMethods)},
+		{Name: "filter-paths", Middleware: copilotproxy.FilterPaths(allowPaths, denyPaths)},
+		{Name: "quota", Middleware: copilotproxy.EnforceQuotas(quotas)},
+		{Name: "limit-keys", Middleware: copilotproxy.LimitKeys(keyLimiter)},
+		{Name: "usage", Middleware: copilotproxy.RecordUsage(usage, keyLimiter.CountsTokens())},
+		{Name: "body-limit", Middleware: copilotproxy.LimitBody(opts.MaxBodyBytes)},
+		{Name: "validate-json", Middleware: copilotproxy.ValidateJSON(opts.ValidateJSON)},
+		{Name: "static-models", Middleware: copilotproxy.StaticModels(models)},
+		{Name: "cache-models", Middleware: copilotproxy.CacheModels(opts.ModelsCacheTTL)},
+		{Name: "cache-embeddings", Middleware: copilotproxy.CacheEmbeddings(embeddingsCache)},
+		{Name: "circuit-breaker", Middleware: copilotproxy.BreakCircuit(breaker)},
+		{Name: "limit-concurrency", Middleware: copilotproxy.LimitConcurrency(limiter)},
+		{Name: "limit-requests", Middleware: copilotproxy.LimitRequests(budget)},
+		{Name: "debug-bodies", Middleware: copilotproxy.DebugBodies(opts.DebugBodies, opts.DebugBodyBytes)},
+	}, opts.DisableMiddlewares)
+	if err != nil {
+		return fmt.Errorf("failed to build middleware chain: %w", err)
+	}
+	slog.Debug("api middleware chain", "order", chain)
+	apiHandler := copilotproxy.ApplyMiddlewares(proxy, middlewares...)
+	mux.Handle(opts.BasePath+"/", apiHandler)
+	// The translating endpoints read the request before the api chain sees
+	// it, so auth, quotas and the body limit also run in front of them. Token
+	// scopes are left to the api chain, which sees the translated path.
+	translated := []copilotproxy.Middleware{copilotproxy.TrackRequestInfo, copilotproxy.AuthenticateAccessToken(accessKeys, basicCreds), copilotproxy.EnforceQuotas(quotas), copilotproxy.LimitBody(opts.MaxBodyBytes)}
+	if opts.Anthropic {
+		mux.Handle("POST /anthropic/v1/messages", copilotproxy.ApplyMiddlewares(copilotproxy.AnthropicMessages(apiHandler, opts.BasePath+"/chat/completions"), append([]copilotproxy.Middleware{copilotproxy.AnthropicAPIKey}, translated...)...))
+		slog.Info("Anthropic Messages API enabled")
+	}
+	if opts.Ollama {
+		mux.Handle("POST /api/chat", copilotproxy.ApplyMiddlewares(copilotproxy.OllamaChat(apiHandler, opts.BasePath+"/chat/completions", false), translated...))
+		mux.Handle("POST /api/generate", copilotproxy.ApplyMiddlewares(copilotproxy.OllamaChat(apiHandler, opts.BasePath+"/chat/completions", true), translated...))
+		mux.Handle("GET /api/tags", copilotproxy.ApplyMiddlewares(copilotproxy.OllamaTags(apiHandler, opts.BasePath+"/models"), translated...))
+		mux.Handle("POST /api/show", copilotproxy.ApplyMiddlewares(http.HandlerFunc(copilotproxy.OllamaShow), translated...))
+		mux.HandleFunc("GET /api/version", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"version":"` + ollamaVersion + `"}`))
+		})
+		slog.Info("Ollama API enabled")
 	}
-	apiHandler := applyMiddlewares(proxy, middlewares...)
-	mux.Handle(Args.BasePath+"/", apiHandler)
 
-	githubUpstream, _ := url.Parse(GitHubAPIEndpoint)
+	githubUpstream, _ := url.Parse(copilotproxy.GitHubAPIEndpoint)
 	githubProxy := ts.NewGitHubAPIProxy(githubUpstream)
-	githubHandler := applyMiddlewares(githubProxy, verifyAccessToken(Args.AccessToken))
+	githubHandler := copilotproxy.ApplyMiddlewares(githubProxy,
+		copilotproxy.RecoverPanics,
+		copilotproxy.RequestID,
+		copilotproxy.TraceRequests(tracing, "github-api"),
+		auth,
+		copilotproxy.RejectUpgrades(opts.AllowUpgrades),
+		copilotproxy.LimitRequests(budget),
+	)
 	mux.Handle("/copilot_internal/", githubHandler)
+	refreshHandler := copilotproxy.ApplyMiddlewares(copilotproxy.RefreshHandler(pool), auth)
+	mux.Handle("POST /admin/token/refresh", refreshHandler)
+	// Deprecated alias kept for existing callers.
+	mux.Handle("POST /admin/refresh", refreshHandler)
+	mux.Handle("POST /admin/preview", copilotproxy.ApplyMiddlewares(copilotproxy.PreviewHandler(ts, upstreams[0]), auth))
+	if quotas.Enabled() {
+		mux.Handle("GET /quota", copilotproxy.ApplyMiddlewares(copilotproxy.QuotaHandler(quotas), copilotproxy.TrackRequestInfo, auth))
+	}
+	if accessKeys.Len() > 0 {
+		mux.Handle("GET /admin/tokens", copilotproxy.ApplyMiddlewares(copilotproxy.AccessTokensHandler(accessKeys), auth))
+	}
+	expiryGauge := copilotproxy.NewGaugeFunc("copilot_proxy_token_expiry_seconds", "Seconds until the current Copilot token expires.", func() float64 {
+		return time.Until(ts.ExpiresAt()).Seconds()
+	})
+	defer expiryGauge.Unregister()
+	mux.Handle("/metrics", copilotproxy.Metrics)
+	mux.Handle("/metrics.json", copilotproxy.Metrics)
+	mux.HandleFunc("/version", versionHandler)
+	var ln net.Listener
+	mux.Handle("GET /debug/config", copilotproxy.ApplyMiddlewares(configHandler(fs, source, upstreams, func() string { return ln.Addr().String() }), auth))
 	mux.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
-		if ts.Ready() {
+		if shuttingDown.Load() {
+			http.Error(w, "Shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		if budget.Exhausted() {
+			http.Error(w, "Request limit reached", http.StatusServiceUnavailable)
+			return
+		}
+		if pool.RefreshLoopStalled() {
+			http.Error(w, "Token refresh loop stalled", http.StatusServiceUnavailable)
+			return
+		}
+		if reason := entitlement.Degraded(); reason != "" {
+			http.Error(w, "Service degraded: "+reason, http.StatusServiceUnavailable)
+			return
+		}
+		if breaker != nil && breaker.State() == copilotproxy.BreakerOpen {
+			http.Error(w, "Circuit breaker open", http.StatusServiceUnavailable)
+			return
+		}
+		if pool.Ready() {
 			w.WriteHeader(http.StatusOK)
 			_, _ = w.Write([]byte("OK"))
 			return
@@ -343,13 +1588,159 @@ func main() {
 		http.Error(w, "Service not ready", http.StatusServiceUnavailable)
 	})
 
+	if opts.MaxHeaderBytes <= 0 {
+		return fmt.Errorf("invalid max header bytes %d, expected a positive value", opts.MaxHeaderBytes)
+	}
+	slog.Info("request header limit", "max_header_bytes", opts.MaxHeaderBytes)
+
+	var conns atomic.Int64
 	srv := &http.Server{
-		Addr:              Args.Addr,
-		Handler:           mux,
+		Addr:              opts.Addr,
+		Handler:           copilotproxy.ApplyMiddlewares(mux, copilotproxy.AllowCIDRs(allowedPrefixes, opts.TrustProxy)),
 		ReadHeaderTimeout: 5 * time.Second,
+		MaxHeaderBytes:    opts.MaxHeaderBytes,
+		ConnState: func(_ net.Conn, state http.ConnState) {
+			switch state {
+			case http.StateNew:
+				conns.Add(1)
+			case http.StateHijacked, http.StateClosed:
+				conns.Add(-1)
+			}
+		},
+	}
+	var acme *autocert.Manager
+	useTLS := opts.TLSCert != "" || opts.TLSKey != "" || len(opts.ACMEDomains) > 0
+	if useTLS && opts.H2C {
+		return errors.New("-h2c cannot be combined with -tls-cert or -acme-domain")
+	}
+	if len(opts.ACMEDomains) > 0 {
+		if opts.TLSCert != "" || opts.TLSKey != "" {
+			return errors.New("-acme-domain cannot be combined with -tls-cert and -tls-key")
+		}
+		if opts.ACMECacheDir == "" {
+			return errors.New("-acme-domain requires -acme-cache-dir")
+		}
+		acme = &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(opts.ACMEDomains...),
+			Cache:      autocert.DirCache(opts.ACMECacheDir),
+			Email:      opts.ACMEEmail,
+		}
+		srv.TLSConfig = acme.TLSConfig()
+		srv.TLSConfig.MinVersion = tls.VersionTLS12
+		slog.Info("ACME certificates enabled", "domains", opts.ACMEDomains, "cache_dir", opts.ACMECacheDir)
+	} else if useTLS {
+		if opts.TLSCert == "" || opts.TLSKey == "" {
+			return errors.New("-tls-cert and -tls-key must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(opts.TLSCert, opts.TLSKey)
+		if err != nil {
+			return fmt.Errorf("failed to load TLS certificate: %w", err)
+		}
+		srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	} else if opts.HTTPSRedirectAddr != "" {
+		return errors.New("-https-redirect-addr requires -tls-cert and -tls-key or -acme-domain")
+	}
+	if opts.H2C {
+		var protocols http.Protocols
+		protocols.SetHTTP1(true)
+		protocols.SetUnencryptedHTTP2(true)
+		srv.Protocols = &protocols
 	}
 
-	if err := srv.ListenAndServe(); err != nil {
-		panic(err)
+	socketMode, err := strconv.ParseUint(opts.SocketMode, 8, 32)
+	if err != nil || socketMode > 0o777 {
+		return fmt.Errorf("invalid socket mode %q, expected an octal file mode such as 0660", opts.SocketMode)
 	}
+	ln, err = listen(opts.Addr, os.FileMode(socketMode))
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+	slog.Info("listening", "addr", ln.Addr().String(), "tls", useTLS)
+	if opts.MaxConns > 0 {
+		ln = netutil.LimitListener(ln, opts.MaxConns)
+		slog.Info("connection limit enabled", "max_conns", opts.MaxConns)
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				slog.Info("received SIGHUP, reloading configuration")
+				if err := reload(args, initialFlags, accessKeys, models); err != nil {
+					slog.Error("reload failed, keeping the current configuration", "error", err)
+				}
+			}
+		}
+	}()
+
+	serveErr := make(chan error, 2)
+	go func() {
+		if useTLS {
+			serveErr <- srv.ServeTLS(ln, "", "")
+			return
+		}
+		serveErr <- srv.Serve(ln)
+	}()
+
+	if opts.HTTPSRedirectAddr != "" {
+		_, port, _ := net.SplitHostPort(ln.Addr().String())
+		redirect := &http.Server{
+			Addr:              opts.HTTPSRedirectAddr,
+			Handler:           httpsRedirectHandler(port),
+			ReadHeaderTimeout: 5 * time.Second,
+		}
+		if acme != nil {
+			// Answer ACME HTTP-01 challenges, redirect everything else.
+			redirect.Handler = acme.HTTPHandler(redirect.Handler)
+		}
+		redirectLn, err := listen(opts.HTTPSRedirectAddr, os.FileMode(socketMode))
+		if err != nil {
+			_ = srv.Close()
+			return fmt.Errorf("failed to listen for HTTPS redirects: %w", err)
+		}
+		slog.Info("redirecting HTTP to HTTPS", "addr", redirectLn.Addr().String())
+		go func() {
+			serveErr <- redirect.Serve(redirectLn)
+		}()
+		defer redirect.Close()
+	}
+
+	select {
+	case err := <-serveErr:
+		return fmt.Errorf("failed to serve: %w", err)
+	case err := <-fatal:
+		_ = srv.Close()
+		return err
+	case <-ctx.Done():
+	}
+
+	shuttingDown.Store(true)
+	slog.Info("shutting down", "delay", opts.ShutdownDelay)
+	time.Sleep(opts.ShutdownDelay)
+	slog.Info("draining connections", "connections", conns.Load(), "timeout", opts.DrainTimeout)
+
+	drainCtx := context.Background()
+	if opts.DrainTimeout > 0 {
+		var cancel context.CancelFunc
+		drainCtx, cancel = context.WithTimeout(drainCtx, opts.DrainTimeout)
+		defer cancel()
+	}
+	if err := srv.Shutdown(drainCtx); err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			slog.Warn("drain timeout reached, closing remaining connections", "timeout", opts.DrainTimeout, "connections", conns.Load())
+			_ = srv.Close()
+		} else {
+			slog.Error("failed to shut down server", "error", err)
+		}
+	}
+	stopRefresh()
+	refreshing.Wait()
+	slog.Info("server stopped")
+	return nil
 }
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"git.tigerbrokers.net/pangxuyuanp/copilot-api/copilotproxy"
+)
+
+func TestRunRegistersGaugesPerRun(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(copilotproxy.APIToken{Token: "token", ExpiresAt: time.Now().Add(time.Hour).Unix(), RefreshIn: 1500})
+	}))
+	defer server.Close()
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	args := []string{
+		"-addr", "127.0.0.1:0",
+		"-oauth-token", "oauth",
+		"-token-endpoint", server.URL,
+		"-api-endpoint", server.URL,
+		"-upstream-ca", ca,
+		"-breaker-failures", "1",
+		"-max-concurrent", "1",
+	}
+	families := func() int {
+		var out bytes.Buffer
+		copilotproxy.Metrics.WriteText(&out, false)
+		return strings.Count(out.String(), "# TYPE copilot_proxy_circuit_breaker_state ")
+	}
+
+	for i := range 2 {
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() { done <- run(ctx, args, io.Discard) }()
+
+		deadline := time.Now().Add(5 * time.Second)
+		for families() == 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if got := families(); got != 1 {
+			t.Errorf("run %d: %d circuit breaker gauges registered, want 1", i, got)
+		}
+		cancel()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("run %d: %v", i, err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("run %d did not return after cancel", i)
+		}
+		if got := families(); got != 0 {
+			t.Errorf("run %d returned with %d circuit breaker gauges registered, want 0", i, got)
+		}
+	}
+}
+
+func TestConfigHandlerMasksSecrets(t *testing.T) {
+	fs := newFlagSet(&options{}, new(slog.LevelVar))
+	err := fs.Parse([]string{
+		"-basic-auth", "alice:pa,ss",
+		"-basic-auth", "bob:secret",
+		"-access-key", "ci:ci-token:chat,models",
+		"-alert-webhook", "https://hooks.example.com/services/T000/B000/XXXX",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	configHandler(fs, "flag", nil, func() string { return "" })(w, httptest.NewRequest(http.MethodGet, "/debug/config", nil))
+	var config struct {
+		Flags map[string]flagConfig `json:"flags"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &config); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]string{
+		"basic-auth":    "alice:****,bob:****",
+		"access-key":    "ci:****",
+		"alert-webhook": "http****",
+	}
+	for name, want := range tests {
+		if got := config.Flags[name].Value; got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	for _, secret := range []string{"pa,ss", "secret", "ci-token", "XXXX"} {
+		if strings.Contains(w.Body.String(), secret) {
+			t.Errorf("config exposes %q: %s", secret, w.Body)
+		}
+	}
+}